@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -13,15 +15,88 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/nitro/lazyraster/v2/internal"
+	"github.com/nitro/lazyraster/v2/internal/transport"
 )
 
 func main() {
 	var (
-		logger                 = zerolog.New(os.Stdout).With().Timestamp().Caller().Logger().Level(zerolog.InfoLevel)
-		urlSigningSecret       = os.Getenv("URL_SIGNING_SECRET")
-		enableDatadog          = os.Getenv("ENABLE_DATADOG")
-		rawStorageBucketRegion = os.Getenv("STORAGE_BUCKET_REGION")
+		logger                     = zerolog.New(os.Stdout).With().Timestamp().Caller().Logger()
+		rawLogLevel                = os.Getenv("LOG_LEVEL")
+		configFile                 = os.Getenv("CONFIG_FILE")
+		urlSigningSecret           = os.Getenv("URL_SIGNING_SECRET")
+		rawTokenLeeway             = os.Getenv("TOKEN_LEEWAY")
+		rawURLSigningBucketSize    = os.Getenv("URL_SIGNING_BUCKET_SIZE")
+		urlSigningAlgorithm        = os.Getenv("URL_SIGNING_ALGORITHM")
+		enableDatadog              = os.Getenv("ENABLE_DATADOG")
+		enablePrometheus           = os.Getenv("ENABLE_PROMETHEUS")
+		rawStorageBucketRegion     = os.Getenv("STORAGE_BUCKET_REGION")
+		rawReadBufferSize          = os.Getenv("READ_BUFFER_SIZE")
+		rawS3ReadBufferSize        = os.Getenv("S3_READ_BUFFER_SIZE")
+		azureConnectionString      = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+		azureStorageAccount        = os.Getenv("AZURE_STORAGE_ACCOUNT")
+		azureStorageKey            = os.Getenv("AZURE_STORAGE_KEY")
+		localDir                   = os.Getenv("LOCAL_DOCUMENTS_DIR")
+		rawMaxOpenFiles            = os.Getenv("MAX_OPEN_FILES")
+		rawDocumentCacheSize       = os.Getenv("DOCUMENT_CACHE_SIZE")
+		rawMaxPageCount            = os.Getenv("MAX_PAGE_COUNT")
+		rawMaxImageWidth           = os.Getenv("MAX_IMAGE_WIDTH")
+		rawMinWidth                = os.Getenv("MIN_WIDTH")
+		clampMinWidth              = os.Getenv("CLAMP_MIN_WIDTH")
+		rawCoverWidth              = os.Getenv("COVER_WIDTH")
+		rawCoverHeight             = os.Getenv("COVER_HEIGHT")
+		coverBackground            = os.Getenv("COVER_BACKGROUND")
+		rawValidateConcurrency     = os.Getenv("VALIDATE_CONCURRENCY")
+		basePath                   = os.Getenv("BASE_PATH")
+		defaultToFirstPage         = os.Getenv("DEFAULT_TO_FIRST_PAGE")
+		zeroBasedPages             = os.Getenv("ZERO_BASED_PAGES")
+		contentChecksum            = os.Getenv("CONTENT_CHECKSUM")
+		rawBucketRenderDefaults    = os.Getenv("BUCKET_RENDER_DEFAULTS")
+		rawMaxConcurrentRenders    = os.Getenv("MAX_CONCURRENT_RENDERS")
+		rawRenderQueueDepth        = os.Getenv("RENDER_QUEUE_DEPTH")
+		rawRateLimit               = os.Getenv("RATE_LIMIT")
+		rawRateLimitBurst          = os.Getenv("RATE_LIMIT_BURST")
+		rawMaxDocumentRenders      = os.Getenv("MAX_DOCUMENT_RENDERS")
+		rawReadinessQueueThreshold = os.Getenv("READINESS_QUEUE_THRESHOLD")
+		renderPrioritySecret       = os.Getenv("RENDER_PRIORITY_SECRET")
+		rawThumbnailWidth          = os.Getenv("THUMBNAIL_WIDTH")
+		debugSecret                = os.Getenv("DEBUG_SECRET")
+		adminSecret                = os.Getenv("ADMIN_SECRET")
+		rawCORSAllowedOrigins      = os.Getenv("CORS_ALLOWED_ORIGINS")
+		rawLogRedactedHeaders      = os.Getenv("LOG_REDACTED_HEADERS")
+		rawLogRedactedParams       = os.Getenv("LOG_REDACTED_PARAMS")
+		rawCompressionLevel        = os.Getenv("COMPRESSION_LEVEL")
+		rawHTTPPort                = os.Getenv("HTTP_PORT")
+		rawReadTimeout             = os.Getenv("READ_TIMEOUT")
+		rawWriteTimeout            = os.Getenv("WRITE_TIMEOUT")
+		rawIdleTimeout             = os.Getenv("IDLE_TIMEOUT")
+		rawRequestTimeout          = os.Getenv("REQUEST_TIMEOUT")
+		rawMaxHeaderBytes          = os.Getenv("MAX_HEADER_BYTES")
+		rawCompressedContentTypes  = os.Getenv("COMPRESSED_CONTENT_TYPES")
+		tlsCertFile                = os.Getenv("TLS_CERT_FILE")
+		tlsKeyFile                 = os.Getenv("TLS_KEY_FILE")
+		rawTLSMinVersion           = os.Getenv("TLS_MIN_VERSION")
 	)
+
+	// The level is applied by a sampler instead of globally, so it can be changed at runtime by reloading the
+	// configuration and the requests being debugged can still log below it.
+	logLevel, err := parseLogLevel(rawLogLevel)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'LOG_LEVEL' payload")
+	}
+	var levels levelSampler
+	levels.set(logLevel)
+	logger = logger.Sample(&levels)
+
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		ctx, ctxCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer ctxCancel()
+		if err := selfTest(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Self-test failed")
+		}
+		logger.Info().Msg("Self-test passed")
+		return
+	}
+
 	if urlSigningSecret == "" {
 		logger.Fatal().Msg("Environment variable 'URL_SIGNING_SECRET' can't be empty")
 	}
@@ -34,18 +109,209 @@ func main() {
 		logger.Fatal().Msg("Fail to parse the environment variable 'STORAGE_BUCKET_REGION' payload")
 	}
 
+	tokenLeeway, err := parseOptionalDuration(rawTokenLeeway)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'TOKEN_LEEWAY' payload")
+	}
+
+	urlSigningBucketSize, err := parseOptionalDuration(rawURLSigningBucketSize)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'URL_SIGNING_BUCKET_SIZE' payload")
+	}
+
+	// S3_READ_BUFFER_SIZE is the name used before the buffer was shared by every storage.
+	if rawReadBufferSize == "" {
+		rawReadBufferSize = rawS3ReadBufferSize
+	}
+	readBufferSize, err := parseOptionalInt(rawReadBufferSize)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'READ_BUFFER_SIZE' payload")
+	}
+
+	documentCacheSize, err := parseOptionalInt(rawDocumentCacheSize)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'DOCUMENT_CACHE_SIZE' payload")
+	}
+
+	maxOpenFiles, err := parseOptionalInt(rawMaxOpenFiles)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_OPEN_FILES' payload")
+	}
+
+	maxPageCount, err := parseOptionalInt(rawMaxPageCount)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_PAGE_COUNT' payload")
+	}
+
+	maxImageWidth, err := parseOptionalInt(rawMaxImageWidth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_IMAGE_WIDTH' payload")
+	}
+	if rawMaxImageWidth != "" && maxImageWidth <= 0 {
+		logger.Fatal().Msg("Environment variable 'MAX_IMAGE_WIDTH' must be bigger than zero")
+	}
+
+	minWidth, err := parseOptionalInt(rawMinWidth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MIN_WIDTH' payload")
+	}
+
+	coverWidth, err := parseOptionalInt(rawCoverWidth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'COVER_WIDTH' payload")
+	}
+
+	coverHeight, err := parseOptionalInt(rawCoverHeight)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'COVER_HEIGHT' payload")
+	}
+
+	validateConcurrency, err := parseOptionalInt(rawValidateConcurrency)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'VALIDATE_CONCURRENCY' payload")
+	}
+
+	maxConcurrentRenders, err := parseOptionalInt(rawMaxConcurrentRenders)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_CONCURRENT_RENDERS' payload")
+	}
+
+	renderQueueDepth, err := parseOptionalInt(rawRenderQueueDepth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'RENDER_QUEUE_DEPTH' payload")
+	}
+
+	bucketRenderDefaults, err := parseBucketRenderDefaults(rawBucketRenderDefaults)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'BUCKET_RENDER_DEFAULTS' payload")
+	}
+
+	rateLimit, err := parseOptionalFloat(rawRateLimit)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'RATE_LIMIT' payload")
+	}
+
+	rateLimitBurst, err := parseOptionalInt(rawRateLimitBurst)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'RATE_LIMIT_BURST' payload")
+	}
+
+	maxDocumentRenders, err := parseOptionalInt(rawMaxDocumentRenders)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_DOCUMENT_RENDERS' payload")
+	}
+
+	readinessQueueThreshold, err := parseOptionalInt(rawReadinessQueueThreshold)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'READINESS_QUEUE_THRESHOLD' payload")
+	}
+
+	thumbnailWidth, err := parseOptionalInt(rawThumbnailWidth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'THUMBNAIL_WIDTH' payload")
+	}
+
+	compressionLevel, err := parseOptionalInt(rawCompressionLevel)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'COMPRESSION_LEVEL' payload")
+	}
+
+	httpPort, err := parseOptionalInt(rawHTTPPort)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'HTTP_PORT' payload")
+	}
+
+	readTimeout, err := parseOptionalDuration(rawReadTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'READ_TIMEOUT' payload")
+	}
+
+	writeTimeout, err := parseOptionalDuration(rawWriteTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'WRITE_TIMEOUT' payload")
+	}
+
+	idleTimeout, err := parseOptionalDuration(rawIdleTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'IDLE_TIMEOUT' payload")
+	}
+
+	requestTimeout, err := parseOptionalDuration(rawRequestTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'REQUEST_TIMEOUT' payload")
+	}
+
+	maxHeaderBytes, err := parseOptionalInt(rawMaxHeaderBytes)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'MAX_HEADER_BYTES' payload")
+	}
+
+	tlsMinVersion, err := parseTLSMinVersion(rawTLSMinVersion)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Fail to parse the environment variable 'TLS_MIN_VERSION' payload")
+	}
+
 	waitHandlerAsyncError, waitHandler := wait(logger)
 	client := internal.Client{
-		Logger:              logger,
-		AsyncErrorHandler:   waitHandlerAsyncError,
-		URLSigningSecret:    urlSigningSecret,
-		EnableDatadog:       enableDatadog == "true",
-		StorageBucketRegion: storageBucketRegion,
+		Logger:                  logger,
+		AsyncErrorHandler:       waitHandlerAsyncError,
+		URLSigningSecret:        urlSigningSecret,
+		TokenLeeway:             tokenLeeway,
+		URLSigningBucketSize:    urlSigningBucketSize,
+		URLSigningAlgorithm:     urlSigningAlgorithm,
+		EnableDatadog:           enableDatadog == "true",
+		EnablePrometheus:        enablePrometheus == "true",
+		StorageBucketRegion:     storageBucketRegion,
+		ReadBufferSize:          readBufferSize,
+		AzureConnectionString:   azureConnectionString,
+		AzureStorageAccount:     azureStorageAccount,
+		AzureStorageKey:         azureStorageKey,
+		LocalDir:                localDir,
+		MaxOpenFiles:            maxOpenFiles,
+		DocumentCacheSize:       documentCacheSize,
+		MaxPageCount:            maxPageCount,
+		MaxImageWidth:           maxImageWidth,
+		MinWidth:                minWidth,
+		ClampMinWidth:           clampMinWidth == "true",
+		CoverWidth:              coverWidth,
+		CoverHeight:             coverHeight,
+		CoverBackground:         coverBackground,
+		ValidateConcurrency:     validateConcurrency,
+		BasePath:                basePath,
+		DefaultToFirstPage:      defaultToFirstPage == "true",
+		ZeroBasedPages:          zeroBasedPages == "true",
+		ContentChecksum:         contentChecksum == "true",
+		BucketRenderDefaults:    bucketRenderDefaults,
+		MaxConcurrentRenders:    maxConcurrentRenders,
+		RenderQueueDepth:        renderQueueDepth,
+		RenderPrioritySecret:    renderPrioritySecret,
+		RateLimit:               rateLimit,
+		RateLimitBurst:          rateLimitBurst,
+		MaxDocumentRenders:      maxDocumentRenders,
+		ReadinessQueueThreshold: readinessQueueThreshold,
+		ThumbnailWidth:          thumbnailWidth,
+		DebugSecret:             debugSecret,
+		AdminSecret:             adminSecret,
+		CORSAllowedOrigins:      parseList(rawCORSAllowedOrigins),
+		LogRedactedHeaders:      parseList(rawLogRedactedHeaders),
+		LogRedactedParams:       parseList(rawLogRedactedParams),
+		CompressionLevel:        compressionLevel,
+		Port:                    httpPort,
+		ReadTimeout:             readTimeout,
+		WriteTimeout:            writeTimeout,
+		IdleTimeout:             idleTimeout,
+		RequestTimeout:          requestTimeout,
+		MaxHeaderBytes:          maxHeaderBytes,
+		CompressedContentTypes:  parseList(rawCompressedContentTypes),
+		TLSCertFile:             tlsCertFile,
+		TLSKeyFile:              tlsKeyFile,
+		TLSMinVersion:           tlsMinVersion,
 	}
 	if err := client.Init(); err != nil {
 		logger.Fatal().Err(err).Msg("Fail to initialize the client")
 	}
 	client.Start()
+	watchReload(logger, configFile, &client, &levels)
 
 	exitStatus := waitHandler()
 	ctx, ctxCancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -95,3 +361,96 @@ func parseStorageBucketRegion(payload string) (map[string]string, error) {
 	}
 	return result, nil
 }
+
+func parseBucketRenderDefaults(payload string) (map[string]transport.RenderDefaults, error) {
+	if payload == "" {
+		return nil, nil
+	}
+	result := make(map[string]transport.RenderDefaults)
+	for _, segment := range strings.Split(payload, ";") {
+		fragments := strings.Split(segment, ":")
+		if len(fragments) != 2 {
+			return nil, errors.New("invalid payload")
+		}
+
+		var defaults transport.RenderDefaults
+		for _, param := range strings.Split(fragments[1], ",") {
+			keyValue := strings.Split(param, "=")
+			if len(keyValue) != 2 {
+				return nil, fmt.Errorf("invalid parameter '%s'", param)
+			}
+			value := strings.TrimSpace(keyValue[1])
+			switch key := strings.TrimSpace(keyValue[0]); key {
+			case "width":
+				width, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid width '%s': %w", value, err)
+				}
+				defaults.Width = width
+			case "format":
+				defaults.Format = value
+			case "quality":
+				quality, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid quality '%s': %w", value, err)
+				}
+				defaults.Quality = quality
+			default:
+				return nil, fmt.Errorf("unknown parameter '%s'", key)
+			}
+		}
+		result[strings.TrimSpace(fragments[0])] = defaults
+	}
+	return result, nil
+}
+
+func parseLogLevel(payload string) (zerolog.Level, error) {
+	if payload == "" {
+		return zerolog.InfoLevel, nil
+	}
+	return zerolog.ParseLevel(payload)
+}
+
+func parseTLSMinVersion(payload string) (uint16, error) {
+	switch payload {
+	case "":
+		return 0, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version '%s', expected '1.2' or '1.3'", payload)
+	}
+}
+
+func parseOptionalInt(payload string) (int, error) {
+	if payload == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(payload)
+}
+
+func parseOptionalFloat(payload string) (float64, error) {
+	if payload == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(payload, 64)
+}
+
+func parseOptionalDuration(payload string) (time.Duration, error) {
+	if payload == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(payload)
+}
+
+func parseList(payload string) []string {
+	var result []string
+	for _, item := range strings.Split(payload, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rs/zerolog"
+
+	"github.com/nitro/lazyraster/v2/internal"
+)
+
+// reloadableSettings can be changed without restarting the service, any other setting found at the configuration file
+// is ignored.
+var reloadableSettings = map[string]struct{}{
+	"LOG_LEVEL":              {},
+	"MAX_CONCURRENT_RENDERS": {},
+	"RENDER_QUEUE_DEPTH":     {},
+	"RATE_LIMIT":             {},
+	"RATE_LIMIT_BURST":       {},
+	"MAX_DOCUMENT_RENDERS":   {},
+}
+
+// levelSampler drops the log entries below the level. The requests being debugged remove the sampler from their
+// logger to log at the debug level.
+type levelSampler struct {
+	level int32
+}
+
+func (s *levelSampler) Sample(level zerolog.Level) bool {
+	return level >= s.get()
+}
+
+func (s *levelSampler) get() zerolog.Level {
+	return zerolog.Level(atomic.LoadInt32(&s.level))
+}
+
+func (s *levelSampler) set(level zerolog.Level) {
+	atomic.StoreInt32(&s.level, int32(level))
+}
+
+// watchReload reloads the configuration file every time the process receives a SIGHUP. Without a configuration file
+// there is nothing to reload, the signal is only logged.
+func watchReload(logger zerolog.Logger, path string, client *internal.Client, levels *levelSampler) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	go func() {
+		for range signalChan {
+			if path == "" {
+				logger.Warn().Msg("Can't reload the configuration, the environment variable 'CONFIG_FILE' isn't set")
+				continue
+			}
+			logger.Info().Str("path", path).Msg("Reloading the configuration")
+			if err := reloadConfig(logger, path, client, levels); err != nil {
+				logger.Error().Err(err).Msg("Fail to reload the configuration")
+			}
+		}
+	}()
+}
+
+// reloadConfig applies the reloadable settings from the configuration file. The file has one 'KEY=VALUE' per line,
+// using the same keys as the environment variables.
+func reloadConfig(logger zerolog.Logger, path string, client *internal.Client, levels *levelSampler) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("fail to read the configuration file: %w", err)
+	}
+	for key := range settings {
+		if _, ok := reloadableSettings[key]; !ok {
+			logger.Warn().Str("setting", key).Msg("The setting requires a restart to change, ignoring it")
+		}
+	}
+
+	if rawLogLevel, ok := settings["LOG_LEVEL"]; ok {
+		level, err := parseLogLevel(rawLogLevel)
+		if err != nil {
+			return fmt.Errorf("fail to parse the setting 'LOG_LEVEL': %w", err)
+		}
+		if current := levels.get(); current != level {
+			// Logged before the change, otherwise raising the level would hide the message.
+			logger.Info().Str("from", current.String()).Str("to", level.String()).Msg("Log level changed")
+			levels.set(level)
+		}
+	}
+
+	maxConcurrentRenders, renderQueueDepth := client.MaxConcurrentRenders, client.RenderQueueDepth
+	if rawMaxConcurrentRenders, ok := settings["MAX_CONCURRENT_RENDERS"]; ok {
+		if maxConcurrentRenders, err = strconv.Atoi(rawMaxConcurrentRenders); err != nil {
+			return fmt.Errorf("fail to parse the setting 'MAX_CONCURRENT_RENDERS': %w", err)
+		}
+	}
+	if rawRenderQueueDepth, ok := settings["RENDER_QUEUE_DEPTH"]; ok {
+		if renderQueueDepth, err = strconv.Atoi(rawRenderQueueDepth); err != nil {
+			return fmt.Errorf("fail to parse the setting 'RENDER_QUEUE_DEPTH': %w", err)
+		}
+	}
+	if maxConcurrentRenders != client.MaxConcurrentRenders || renderQueueDepth != client.RenderQueueDepth {
+		logger.Info().
+			Int("fromMaxConcurrentRenders", client.MaxConcurrentRenders).
+			Int("toMaxConcurrentRenders", maxConcurrentRenders).
+			Int("fromRenderQueueDepth", client.RenderQueueDepth).
+			Int("toRenderQueueDepth", renderQueueDepth).
+			Msg("Render limits changed")
+		if err := client.SetRenderLimits(maxConcurrentRenders, renderQueueDepth); err != nil {
+			return fmt.Errorf("fail to change the render limits: %w", err)
+		}
+	}
+
+	rateLimit, rateLimitBurst := client.RateLimit, client.RateLimitBurst
+	if rawRateLimit, ok := settings["RATE_LIMIT"]; ok {
+		if rateLimit, err = strconv.ParseFloat(rawRateLimit, 64); err != nil {
+			return fmt.Errorf("fail to parse the setting 'RATE_LIMIT': %w", err)
+		}
+	}
+	if rawRateLimitBurst, ok := settings["RATE_LIMIT_BURST"]; ok {
+		if rateLimitBurst, err = strconv.Atoi(rawRateLimitBurst); err != nil {
+			return fmt.Errorf("fail to parse the setting 'RATE_LIMIT_BURST': %w", err)
+		}
+	}
+	if rateLimit != client.RateLimit || rateLimitBurst != client.RateLimitBurst {
+		logger.Info().
+			Float64("fromRateLimit", client.RateLimit).
+			Float64("toRateLimit", rateLimit).
+			Int("fromRateLimitBurst", client.RateLimitBurst).
+			Int("toRateLimitBurst", rateLimitBurst).
+			Msg("Rate limit changed")
+		if err := client.SetRateLimit(rateLimit, rateLimitBurst); err != nil {
+			return fmt.Errorf("fail to change the rate limit: %w", err)
+		}
+	}
+
+	if rawMaxDocumentRenders, ok := settings["MAX_DOCUMENT_RENDERS"]; ok {
+		maxDocumentRenders, err := strconv.Atoi(rawMaxDocumentRenders)
+		if err != nil {
+			return fmt.Errorf("fail to parse the setting 'MAX_DOCUMENT_RENDERS': %w", err)
+		}
+		if maxDocumentRenders != client.MaxDocumentRenders {
+			logger.Info().
+				Int("from", client.MaxDocumentRenders).
+				Int("to", maxDocumentRenders).
+				Msg("Max document renders changed")
+			if err := client.SetMaxDocumentRenders(maxDocumentRenders); err != nil {
+				return fmt.Errorf("fail to change the max document renders: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fragments := strings.SplitN(line, "=", 2)
+		if len(fragments) != 2 {
+			return nil, fmt.Errorf("invalid line '%s', expected 'KEY=VALUE'", line)
+		}
+		result[strings.TrimSpace(fragments[0])] = strings.TrimSpace(fragments[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
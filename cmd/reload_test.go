@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nitro/lazyraster/v2/internal"
+)
+
+func TestReloadConfig(t *testing.T) {
+	t.Parallel()
+
+	var levels levelSampler
+	levels.set(zerolog.InfoLevel)
+
+	path := filepath.Join(t.TempDir(), "config")
+	payload := "# Changed by the operator.\nLOG_LEVEL=debug\nBASE_PATH=/raster\n"
+	require.NoError(t, os.WriteFile(path, []byte(payload), 0o600))
+
+	require.NoError(t, reloadConfig(zerolog.Nop(), path, &internal.Client{}, &levels))
+	require.Equal(t, zerolog.DebugLevel, levels.get())
+
+	require.NoError(t, os.WriteFile(path, []byte("LOG_LEVEL=verbose\n"), 0o600))
+	require.Error(t, reloadConfig(zerolog.Nop(), path, &internal.Client{}, &levels))
+	require.Equal(t, zerolog.DebugLevel, levels.get())
+}
+
+func TestReloadConfigRateLimit(t *testing.T) {
+	t.Parallel()
+
+	client := internal.Client{
+		Logger:              zerolog.Nop(),
+		AsyncErrorHandler:   func(error) {},
+		URLSigningSecret:    "secret",
+		StorageBucketRegion: map[string]string{"bucket": "us-east-1"},
+		RateLimit:           1,
+		MaxDocumentRenders:  1,
+	}
+	require.NoError(t, client.Init())
+
+	path := filepath.Join(t.TempDir(), "config")
+	payload := "RATE_LIMIT=10\nRATE_LIMIT_BURST=20\nMAX_DOCUMENT_RENDERS=2\n"
+	require.NoError(t, os.WriteFile(path, []byte(payload), 0o600))
+
+	var levels levelSampler
+	require.NoError(t, reloadConfig(zerolog.Nop(), path, &client, &levels))
+	require.Equal(t, float64(10), client.RateLimit)
+	require.Equal(t, 20, client.RateLimitBurst)
+	require.Equal(t, 2, client.MaxDocumentRenders)
+
+	require.NoError(t, os.WriteFile(path, []byte("RATE_LIMIT=0\n"), 0o600))
+	require.Error(t, reloadConfig(zerolog.Nop(), path, &client, &levels))
+	require.Equal(t, float64(10), client.RateLimit)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed" // Required by the selfTestDocument embed.
+	"errors"
+	"fmt"
+	"image/png"
+
+	"github.com/nitro/lazypdf/v2"
+)
+
+//go:embed selftest.pdf
+var selfTestDocument []byte
+
+// selfTest renders the first page of the embedded document to check that the binary and its native dependencies are
+// working. It's meant to be used by init containers before the service goes live.
+func selfTest(ctx context.Context) error {
+	pageCount, err := lazypdf.PageCount(ctx, bytes.NewReader(selfTestDocument))
+	if err != nil {
+		return fmt.Errorf("fail to count the document pages: %w", err)
+	}
+	if pageCount == 0 {
+		return errors.New("expected the document to have at least one page")
+	}
+
+	var output bytes.Buffer
+	if err := lazypdf.SaveToPNG(ctx, 0, 0, 0, bytes.NewReader(selfTestDocument), &output); err != nil {
+		return fmt.Errorf("fail to render the document: %w", err)
+	}
+
+	cfg, err := png.DecodeConfig(&output)
+	if err != nil {
+		return fmt.Errorf("fail to decode the rendered page: %w", err)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return errors.New("the rendered page is empty")
+	}
+	return nil
+}
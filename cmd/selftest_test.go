@@ -0,0 +1,13 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, selfTest(context.Background()))
+}
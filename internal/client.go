@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/rs/zerolog"
 	ddHTTP "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
@@ -18,11 +20,59 @@ import (
 
 // Client holds the logic to bootstrap the application.
 type Client struct {
-	Logger              zerolog.Logger
-	AsyncErrorHandler   func(error)
-	URLSigningSecret    string
-	EnableDatadog       bool
-	StorageBucketRegion map[string]string
+	Logger                  zerolog.Logger
+	AsyncErrorHandler       func(error)
+	URLSigningSecret        string
+	TokenLeeway             time.Duration
+	URLSigningBucketSize    time.Duration
+	URLSigningAlgorithm     string
+	EnableDatadog           bool
+	EnablePrometheus        bool
+	StorageBucketRegion     map[string]string
+	ReadBufferSize          int
+	AzureConnectionString   string
+	AzureStorageAccount     string
+	AzureStorageKey         string
+	LocalDir                string
+	MaxOpenFiles            int
+	DocumentCacheSize       int
+	MaxPageCount            int
+	MaxImageWidth           int
+	MinWidth                int
+	ClampMinWidth           bool
+	CoverWidth              int
+	CoverHeight             int
+	CoverBackground         string
+	ValidateConcurrency     int
+	ThumbnailWidth          int
+	BasePath                string
+	DefaultToFirstPage      bool
+	ZeroBasedPages          bool
+	ContentChecksum         bool
+	BucketRenderDefaults    map[string]transport.RenderDefaults
+	MaxConcurrentRenders    int
+	RenderQueueDepth        int
+	RenderPrioritySecret    string
+	RateLimit               float64
+	RateLimitBurst          int
+	MaxDocumentRenders      int
+	ReadinessQueueThreshold int
+	DebugSecret             string
+	AdminSecret             string
+	CORSAllowedOrigins      []string
+	LogRedactedHeaders      []string
+	LogRedactedParams       []string
+	CompressionLevel        int
+	Port                    int
+	ReadTimeout             time.Duration
+	WriteTimeout            time.Duration
+	IdleTimeout             time.Duration
+	RequestTimeout          time.Duration
+	MaxHeaderBytes          int
+	CompressedContentTypes  []string
+	TLSCertFile             string
+	TLSKeyFile              string
+	TLSMinVersion           uint16
 
 	server        transport.Server
 	serviceWorker service.Worker
@@ -75,11 +125,41 @@ func (c *Client) Init() (err error) {
 		}()
 	}
 
+	// The metrics are kept at a dedicated registry, so only the collectors of the service are exposed.
+	var registry *prometheus.Registry
+	if c.EnablePrometheus {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(
+			collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
 	c.serviceWorker.URLSigningSecret = c.URLSigningSecret
+	c.serviceWorker.TokenLeeway = c.TokenLeeway
+	c.serviceWorker.URLSigningBucketSize = c.URLSigningBucketSize
+	c.serviceWorker.URLSigningAlgorithm = c.URLSigningAlgorithm
 	c.serviceWorker.HTTPClient = httpClient
 	c.serviceWorker.Logger = c.Logger
 	c.serviceWorker.TraceExtractor = traceLogger(c.EnableDatadog)
 	c.serviceWorker.StorageBucketRegion = c.StorageBucketRegion
+	c.serviceWorker.ReadBufferSize = c.ReadBufferSize
+	c.serviceWorker.AzureStorageConnectionString = c.AzureConnectionString
+	c.serviceWorker.AzureStorageAccount = c.AzureStorageAccount
+	c.serviceWorker.AzureStorageKey = c.AzureStorageKey
+	c.serviceWorker.LocalDir = c.LocalDir
+	c.serviceWorker.MaxOpenFiles = c.MaxOpenFiles
+	c.serviceWorker.DocumentCacheSize = c.DocumentCacheSize
+	c.serviceWorker.MaxPageCount = c.MaxPageCount
+	c.serviceWorker.MaxImageWidth = c.MaxImageWidth
+	c.serviceWorker.MinWidth = c.MinWidth
+	c.serviceWorker.ClampMinWidth = c.ClampMinWidth
+	c.serviceWorker.CoverWidth = c.CoverWidth
+	c.serviceWorker.CoverHeight = c.CoverHeight
+	c.serviceWorker.CoverBackground = c.CoverBackground
+	c.serviceWorker.ValidateConcurrency = c.ValidateConcurrency
+	if registry != nil {
+		c.serviceWorker.MetricsRegisterer = registry
+	}
 	if err := c.serviceWorker.Init(); err != nil {
 		return fmt.Errorf("fail to initialize service worker: %w", err)
 	}
@@ -88,6 +168,36 @@ func (c *Client) Init() (err error) {
 	c.server.AsyncErrorHandler = c.AsyncErrorHandler
 	c.server.TraceExtractor = traceLogger(c.EnableDatadog)
 	c.server.DocumentService = &c.serviceWorker
+	c.server.BasePath = c.BasePath
+	c.server.DefaultToFirstPage = c.DefaultToFirstPage
+	c.server.ZeroBasedPages = c.ZeroBasedPages
+	c.server.ContentChecksum = c.ContentChecksum
+	c.server.BucketRenderDefaults = c.BucketRenderDefaults
+	c.server.MaxConcurrentRenders = c.MaxConcurrentRenders
+	c.server.RenderQueueDepth = c.RenderQueueDepth
+	c.server.RenderPrioritySecret = c.RenderPrioritySecret
+	c.server.RateLimit = c.RateLimit
+	c.server.RateLimitBurst = c.RateLimitBurst
+	c.server.MaxDocumentRenders = c.MaxDocumentRenders
+	c.server.ReadinessQueueThreshold = c.ReadinessQueueThreshold
+	c.server.ThumbnailWidth = c.ThumbnailWidth
+	c.server.DebugSecret = c.DebugSecret
+	c.server.AdminSecret = c.AdminSecret
+	c.server.CORSAllowedOrigins = c.CORSAllowedOrigins
+	c.server.LogRedactedHeaders = c.LogRedactedHeaders
+	c.server.LogRedactedParams = c.LogRedactedParams
+	c.server.CompressionLevel = c.CompressionLevel
+	c.server.Port = c.Port
+	c.server.ReadTimeout = c.ReadTimeout
+	c.server.WriteTimeout = c.WriteTimeout
+	c.server.IdleTimeout = c.IdleTimeout
+	c.server.RequestTimeout = c.RequestTimeout
+	c.server.MaxHeaderBytes = c.MaxHeaderBytes
+	c.server.CompressedContentTypes = c.CompressedContentTypes
+	c.server.MetricsRegistry = registry
+	c.server.TLSCertFile = c.TLSCertFile
+	c.server.TLSKeyFile = c.TLSKeyFile
+	c.server.TLSMinVersion = c.TLSMinVersion
 	if err := c.server.Init(); err != nil {
 		return fmt.Errorf("fail to initialize the transport server: %w", err)
 	}
@@ -95,6 +205,35 @@ func (c *Client) Init() (err error) {
 	return nil
 }
 
+// SetRenderLimits changes the render concurrency and queue depth of the running server.
+func (c *Client) SetRenderLimits(maxConcurrentRenders, renderQueueDepth int) error {
+	if err := c.server.SetRenderLimits(maxConcurrentRenders, renderQueueDepth); err != nil {
+		return fmt.Errorf("fail to set the server render limits: %w", err)
+	}
+	c.MaxConcurrentRenders = maxConcurrentRenders
+	c.RenderQueueDepth = renderQueueDepth
+	return nil
+}
+
+// SetRateLimit changes the client rate limit of the running server.
+func (c *Client) SetRateLimit(rateLimit float64, rateLimitBurst int) error {
+	if err := c.server.SetRateLimit(rateLimit, rateLimitBurst); err != nil {
+		return fmt.Errorf("fail to set the server rate limit: %w", err)
+	}
+	c.RateLimit = rateLimit
+	c.RateLimitBurst = rateLimitBurst
+	return nil
+}
+
+// SetMaxDocumentRenders changes the concurrent renders of the same document of the running server.
+func (c *Client) SetMaxDocumentRenders(maxDocumentRenders int) error {
+	if err := c.server.SetMaxDocumentRenders(maxDocumentRenders); err != nil {
+		return fmt.Errorf("fail to set the server max document renders: %w", err)
+	}
+	c.MaxDocumentRenders = maxDocumentRenders
+	return nil
+}
+
 // Start the client.
 func (c *Client) Start() {
 	c.server.Start()
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// azurePrefix identifies the documents stored at Azure Blob Storage, the path is 'azblob://container/blob'.
+const azurePrefix = "azblob://"
+
+func (w *Worker) fetchFileFromAzure(ctx context.Context, path string) (_ []byte, err error) {
+	span, ctx := ddTracer.StartSpanFromContext(ctx, "Worker.fetchFileFromAzure")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	fragments := strings.SplitN(strings.TrimPrefix(path, azurePrefix), "/", 2)
+	if len(fragments) < 2 || fragments[0] == "" || fragments[1] == "" {
+		return nil, newClientError(errors.New("invalid path"))
+	}
+
+	reader, err := w.getAzureReader(ctx, fragments[0], fragments[1])
+	if err != nil {
+		var storageErr azblob.StorageError
+		if errors.As(err, &storageErr) {
+			switch storageErr.ServiceCode() {
+			case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound:
+				return nil, newNotFoundError(err)
+			}
+		}
+		return nil, fmt.Errorf("fail to get blob: %w", err)
+	}
+	defer reader.Close()
+
+	payload, err := w.readBody(reader)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read the reader: %w", err)
+	}
+	span.SetTag("fileSize", len(payload))
+
+	return payload, nil
+}
+
+// azureBlobReader downloads the blob with the service client of the storage account, it's created on the first use.
+func (w *Worker) azureBlobReader(ctx context.Context, container, blob string) (io.ReadCloser, error) {
+	w.mutex.Lock()
+	service, ok := w.azureServices[w.azureAccount.name]
+	if !ok {
+		if w.azureAccount.name == "" {
+			w.mutex.Unlock()
+			return nil, errors.New("the Azure storage account isn't configured")
+		}
+		credential, err := azblob.NewSharedKeyCredential(w.azureAccount.name, w.azureAccount.key)
+		if err != nil {
+			w.mutex.Unlock()
+			return nil, fmt.Errorf("fail to create the Azure credential: %w", err)
+		}
+		service = azblob.NewServiceURL(*w.azureAccount.endpoint, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+		w.azureServices[w.azureAccount.name] = service
+	}
+	w.mutex.Unlock()
+
+	resp, err := service.NewContainerURL(container).NewBlobURL(blob).Download(
+		ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// azureAccount is the storage account used to read the blobs.
+type azureAccount struct {
+	name     string
+	key      string
+	endpoint *url.URL
+}
+
+// parseAzureAccount builds the account from the connection string, like
+// 'DefaultEndpointsProtocol=https;AccountName=name;AccountKey=key;EndpointSuffix=core.windows.net', or from the name
+// and key when the connection string is empty.
+func parseAzureAccount(connectionString, name, key string) (azureAccount, error) {
+	var (
+		protocol = "https"
+		suffix   = "core.windows.net"
+		endpoint string
+	)
+	for _, fragment := range strings.Split(connectionString, ";") {
+		if fragment == "" {
+			continue
+		}
+		kv := strings.SplitN(fragment, "=", 2)
+		if len(kv) != 2 {
+			return azureAccount{}, fmt.Errorf("invalid connection string fragment '%s'", fragment)
+		}
+		switch kv[0] {
+		case "DefaultEndpointsProtocol":
+			protocol = kv[1]
+		case "AccountName":
+			name = kv[1]
+		case "AccountKey":
+			key = kv[1]
+		case "EndpointSuffix":
+			suffix = kv[1]
+		case "BlobEndpoint":
+			endpoint = kv[1]
+		}
+	}
+	if name == "" {
+		return azureAccount{}, nil
+	}
+	if key == "" {
+		return azureAccount{}, errors.New("the account key can't be empty")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, name, suffix)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return azureAccount{}, fmt.Errorf("invalid blob endpoint: %w", err)
+	}
+	return azureAccount{name: name, key: key, endpoint: endpointURL}, nil
+}
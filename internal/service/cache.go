@@ -0,0 +1,152 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// documentCache keeps the most recently used documents in memory up to a total size in bytes, so the consecutive
+// requests of the same document don't download it again. The concurrent fetches of a document are coalesced, only
+// one of them downloads it while the others wait for the result.
+type documentCache struct {
+	maxSize int
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	fetches map[string]*documentFetch
+	mutex   sync.Mutex
+}
+
+// CachedDocument is a document held by the document cache, the size is in bytes.
+type CachedDocument struct {
+	Path string
+	Size int
+}
+
+type documentCacheEntry struct {
+	path     string
+	document document
+}
+
+type documentFetch struct {
+	done     chan struct{}
+	document document
+	err      error
+}
+
+func newDocumentCache(maxSize int) *documentCache {
+	return &documentCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		fetches: make(map[string]*documentFetch),
+	}
+}
+
+// get returns the cached document or fetches it. When the context is flagged by WithBypassCache the cached document
+// is ignored and replaced by the fetched one.
+func (c *documentCache) get(
+	ctx context.Context, path string, fetch func(context.Context, string) ([]byte, error),
+) (document, error) {
+	bypass := BypassingCache(ctx)
+
+	c.mutex.Lock()
+	if element, ok := c.entries[path]; ok && !bypass {
+		c.order.MoveToFront(element)
+		c.mutex.Unlock()
+		return element.Value.(*documentCacheEntry).document, nil
+	}
+	if f, ok := c.fetches[path]; ok && !bypass {
+		c.mutex.Unlock()
+		select {
+		case <-f.done:
+			return f.document, f.err
+		case <-ctx.Done():
+			return document{}, ctx.Err()
+		}
+	}
+	f := &documentFetch{done: make(chan struct{})}
+	if !bypass {
+		c.fetches[path] = f
+	}
+	c.mutex.Unlock()
+
+	payload, err := fetch(ctx, path)
+	if err == nil {
+		f.document = newDocument(payload)
+	}
+	f.err = err
+
+	c.mutex.Lock()
+	if !bypass {
+		delete(c.fetches, path)
+	}
+	if f.err == nil {
+		c.add(path, f.document)
+	}
+	c.mutex.Unlock()
+	close(f.done)
+	return f.document, f.err
+}
+
+// add stores the document evicting the least recently used ones to make room for it. The documents bigger than the
+// cache aren't stored. The caller must hold the mutex.
+func (c *documentCache) add(path string, doc document) {
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	if len(doc.payload) > c.maxSize {
+		return
+	}
+	for c.size+len(doc.payload) > c.maxSize {
+		c.remove(c.order.Back())
+	}
+	c.entries[path] = c.order.PushFront(&documentCacheEntry{path: path, document: doc})
+	c.size += len(doc.payload)
+}
+
+func (c *documentCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*documentCacheEntry)
+	delete(c.entries, entry.path)
+	c.size -= len(entry.document.payload)
+}
+
+// list returns the cached documents, the most recently used first.
+func (c *documentCache) list() []CachedDocument {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make([]CachedDocument, 0, len(c.entries))
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*documentCacheEntry)
+		result = append(result, CachedDocument{Path: entry.path, Size: len(entry.document.payload)})
+	}
+	return result
+}
+
+// purge removes the document from the cache, or every document when the path is empty. The quantity of documents
+// removed is returned.
+func (c *documentCache) purge(path string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if path != "" {
+		element, ok := c.entries[path]
+		if !ok {
+			return 0
+		}
+		c.remove(element)
+		return 1
+	}
+	purged := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+	return purged
+}
+
+// stats returns the quantity of documents cached and their total size in bytes.
+func (c *documentCache) stats() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries), c.size
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// callGroup coalesces the concurrent calls with the same key, only the first one does the work while the others wait
+// for its result.
+type callGroup struct {
+	calls map[string]*groupCall
+	mutex sync.Mutex
+
+	// waiting is called when a call starts to wait for the one in progress, it's used by the tests.
+	waiting func(key string)
+}
+
+type groupCall struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// do runs fn unless there is a call with the same key in progress, then its result is used instead. The result is
+// shared, so it must not be changed. When the call in progress is canceled by the context of its caller the waiting
+// ones try again with their own context.
+func (g *callGroup) do(
+	ctx context.Context, key string, fn func(context.Context) (interface{}, error),
+) (interface{}, error) {
+	for {
+		g.mutex.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*groupCall)
+		}
+		if c, ok := g.calls[key]; ok {
+			g.mutex.Unlock()
+			if g.waiting != nil {
+				g.waiting(key)
+			}
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if canceled(c.err) && ctx.Err() == nil {
+				continue
+			}
+			return c.result, c.err
+		}
+		c := &groupCall{done: make(chan struct{})}
+		g.calls[key] = c
+		g.mutex.Unlock()
+
+		c.result, c.err = fn(ctx)
+
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(c.done)
+		return c.result, c.err
+	}
+}
+
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"github.com/nitro/lazypdf/v2"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+const (
+	defaultContactSheetColumns    = 4
+	defaultContactSheetThumbWidth = 200
+	maxContactSheetColumns        = 20
+	maxContactSheetThumbWidth     = 600
+
+	// maxContactSheetPages bounds the work and the memory of a contact sheet, every page is kept in memory until the
+	// sheet is composed.
+	maxContactSheetPages = 100
+)
+
+// ContactSheet renders every page of the document at thumbWidth and tiles them, in order, into a single PNG with the
+// given quantity of columns. The document is refused when it has more than maxPages. Zero values use the defaults.
+func (w *Worker) ContactSheet(
+	ctx context.Context, url, path string, columns, thumbWidth, maxPages int, output io.Writer,
+) (err error) {
+	span, ctx := w.startSpan(ctx, "Worker.ContactSheet")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	if columns == 0 {
+		columns = defaultContactSheetColumns
+	} else if columns < 0 || columns > maxContactSheetColumns {
+		return newClientError(fmt.Errorf("invalid columns, must be between 1 and %d", maxContactSheetColumns))
+	}
+	if thumbWidth == 0 {
+		thumbWidth = defaultContactSheetThumbWidth
+	} else if thumbWidth < 0 || thumbWidth > maxContactSheetThumbWidth {
+		return newClientError(fmt.Errorf("invalid thumb width, must be between 1 and %d", maxContactSheetThumbWidth))
+	}
+	thumbWidth, err = w.checkWidth(thumbWidth)
+	if err != nil {
+		return err
+	}
+	if maxPages == 0 {
+		maxPages = maxContactSheetPages
+	} else if maxPages < 0 || maxPages > maxContactSheetPages {
+		return newClientError(fmt.Errorf("invalid max pages, must be between 1 and %d", maxContactSheetPages))
+	}
+
+	if !w.validSignature(url) {
+		return newClientError(errors.New("invalid token"))
+	}
+
+	payload, err := w.fetchFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("fail to fetch the file: %w", err)
+	}
+
+	pageCount, err := lazypdf.PageCount(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("fail to count the file pages: %w", err)
+	}
+	if pageCount > maxPages {
+		return newClientError(fmt.Errorf("document has more than %d pages", maxPages))
+	}
+	if err := w.checkPageCount(pageCount); err != nil {
+		return err
+	}
+
+	// The cells have the height of the tallest page, so documents with mixed page sizes keep the grid aligned.
+	var cellHeight int
+	thumbs := make([]image.Image, 0, pageCount)
+	for page := 0; page < pageCount; page++ {
+		var storage bytes.Buffer
+		err := lazypdf.SaveToPNG(ctx, uint16(page), uint16(thumbWidth), 0, bytes.NewReader(payload), &storage)
+		if err != nil {
+			return fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+		}
+		thumb, err := png.Decode(&storage)
+		if err != nil {
+			return fmt.Errorf("fail to decode the PNG: %w", err)
+		}
+		if height := thumb.Bounds().Dy(); height > cellHeight {
+			cellHeight = height
+		}
+		thumbs = append(thumbs, thumb)
+	}
+
+	if columns > len(thumbs) {
+		columns = len(thumbs)
+	}
+	if columns == 0 {
+		return newClientError(errors.New("document has no pages"))
+	}
+	rows := (len(thumbs) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*thumbWidth, rows*cellHeight))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for i, thumb := range thumbs {
+		origin := image.Pt((i%columns)*thumbWidth, (i/columns)*cellHeight)
+		cell := image.Rectangle{Min: origin, Max: origin.Add(thumb.Bounds().Size())}
+		draw.Draw(sheet, cell, thumb, thumb.Bounds().Min, draw.Src)
+	}
+
+	if err := encodeImage(FormatPNG, 0, sheet, output); err != nil {
+		return fmt.Errorf("fail write the result to the output: %w", err)
+	}
+	return nil
+}
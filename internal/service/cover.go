@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nitro/lazypdf/v2"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// The default cover size follows the Open Graph recommendation, an aspect ratio of 1.91:1.
+const (
+	defaultCoverWidth      = 1200
+	defaultCoverHeight     = 630
+	defaultCoverBackground = "#ffffff"
+
+	// maxCoverHeight bounds the cover height the same way MaxImageWidth bounds its width.
+	maxCoverHeight = 4096
+)
+
+// Cover renders the page as an image for social sharing previews, with the size of CoverWidth by CoverHeight. The
+// page is scaled to the cover width, the top of the page is kept when it's taller than the cover, otherwise it's
+// centered over CoverBackground.
+func (w *Worker) Cover(ctx context.Context, url, path string, page int, format string, output io.Writer) (err error) {
+	span, ctx := w.startSpan(ctx, "Worker.Cover")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	// Check Worker.Process for the reason of this change.
+	page--
+
+	if page < 0 {
+		return newClientError(errors.New("invalid page"))
+	}
+
+	if !validFormat(format) {
+		return newClientError(fmt.Errorf("invalid format '%s'", format))
+	}
+
+	if !w.validSignature(url) {
+		return newClientError(errors.New("invalid token"))
+	}
+
+	doc, err := w.fetchDocument(ctx, path)
+	if err != nil {
+		return fmt.Errorf("fail to fetch the file: %w", err)
+	}
+	if err := w.checkDocumentPages(ctx, doc.payload); err != nil {
+		return err
+	}
+
+	render := Render{Page: page + 1, Width: w.CoverWidth, Format: format, Version: doc.version}
+	if observer, ok := output.(RenderObserver); ok && !observer.Rendering(render) {
+		return nil
+	}
+
+	var storage bytes.Buffer
+	err = lazypdf.SaveToPNG(ctx, uint16(page), uint16(w.CoverWidth), 0, bytes.NewReader(doc.payload), &storage)
+	if err != nil {
+		return fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+	}
+
+	img, err := png.Decode(&storage)
+	if err != nil {
+		return fmt.Errorf("fail to decode the PNG: %w", err)
+	}
+
+	cover := image.NewRGBA(image.Rect(0, 0, w.CoverWidth, w.CoverHeight))
+	draw.Draw(cover, cover.Bounds(), image.NewUniform(w.coverBackground), image.Point{}, draw.Src)
+	bounds := img.Bounds()
+	var offset image.Point
+	if bounds.Dy() < w.CoverHeight {
+		offset.Y = (w.CoverHeight - bounds.Dy()) / 2
+	}
+	draw.Draw(cover, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+
+	if err := encodeImage(format, 0, cover, output); err != nil {
+		return fmt.Errorf("fail write the result to the output: %w", err)
+	}
+	return nil
+}
+
+// parseHexColor parses colors in the format '#rrggbb'.
+func parseHexColor(payload string) (color.RGBA, error) {
+	if len(payload) != 7 || !strings.HasPrefix(payload, "#") {
+		return color.RGBA{}, fmt.Errorf("invalid color '%s', expected the format '#rrggbb'", payload)
+	}
+	value, err := strconv.ParseUint(payload[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color '%s': %w", payload, err)
+	}
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 0xff}, nil
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nitro/lazypdf/v2"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// maxDiffPages bounds the work of a diff, every page of both versions is rendered to be compared.
+const maxDiffPages = 100
+
+// PageDiff is a page that changed between two versions of the document, with its PNG at both versions. Before is
+// empty when the page exists only at the target version.
+type PageDiff struct {
+	Page   int
+	Before []byte
+	After  []byte
+}
+
+// Diff compares two versions of the document page by page and calls changed, in order, for the pages that differ.
+// The pages are compared by their rendered output, only the two renders of the current page are kept in memory, so
+// the images given to changed are only valid during the call. Pages that exist only at the target version are
+// considered changed.
+func (w *Worker) Diff(
+	ctx context.Context, url, path, fromVersion, toVersion string, width int, changed func(PageDiff) error,
+) (err error) {
+	span, ctx := w.startSpan(ctx, "Worker.Diff")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	if fromVersion == "" || toVersion == "" {
+		return newClientError(errors.New("invalid versions"))
+	}
+
+	width, err = w.checkWidth(width)
+	if err != nil {
+		return err
+	}
+
+	if !w.validSignature(url) {
+		return newClientError(errors.New("invalid token"))
+	}
+
+	from, fromPageCount, err := w.fetchDiffVersion(ctx, path, fromVersion)
+	if err != nil {
+		return fmt.Errorf("fail to fetch the version '%s': %w", fromVersion, err)
+	}
+	to, toPageCount, err := w.fetchDiffVersion(ctx, path, toVersion)
+	if err != nil {
+		return fmt.Errorf("fail to fetch the version '%s': %w", toVersion, err)
+	}
+
+	before, after := acquireBuffer(), acquireBuffer()
+	defer releaseBuffer(before)
+	defer releaseBuffer(after)
+	for page := 0; page < toPageCount; page++ {
+		before.Reset()
+		after.Reset()
+		if err := lazypdf.SaveToPNG(ctx, uint16(page), uint16(width), 0, bytes.NewReader(to), after); err != nil {
+			return fmt.Errorf("fail to render the version '%s': %w", toVersion, err)
+		}
+		if page < fromPageCount {
+			err := lazypdf.SaveToPNG(ctx, uint16(page), uint16(width), 0, bytes.NewReader(from), before)
+			if err != nil {
+				return fmt.Errorf("fail to render the version '%s': %w", fromVersion, err)
+			}
+			if bytes.Equal(before.Bytes(), after.Bytes()) {
+				continue
+			}
+		}
+		// The page number is 1 based to match the other endpoints.
+		if err := changed(PageDiff{Page: page + 1, Before: before.Bytes(), After: after.Bytes()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Worker) fetchDiffVersion(ctx context.Context, path, version string) ([]byte, int, error) {
+	payload, err := w.fetchFileVersion(ctx, path, version)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fail to fetch the file: %w", err)
+	}
+
+	pageCount, err := lazypdf.PageCount(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, fmt.Errorf("fail to count the file pages: %w", err)
+	}
+	if pageCount > maxDiffPages {
+		return nil, 0, newClientError(fmt.Errorf("document has more than %d pages", maxDiffPages))
+	}
+	if err := w.checkPageCount(pageCount); err != nil {
+		return nil, 0, err
+	}
+	return payload, pageCount, nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sync"
+
+	"github.com/chai2010/webp"
+)
+
+// The output formats supported by Worker.Process.
+const (
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+	FormatJPEG = "jpeg"
+)
+
+// webpQuality is used for the lossy WebP encoding, it's high enough to keep the text sharp.
+const webpQuality = 90
+
+// The quality of the JPEG encoding can be set per request, from 1 to 100.
+const (
+	defaultJPEGQuality = jpeg.DefaultQuality
+	maxJPEGQuality     = 100
+)
+
+// maxPooledBufferSize keeps the buffers of unusually big pages from being held by the pool.
+const maxPooledBufferSize = 16 << 20
+
+// bufferPool holds the buffers of the pages rendered by lazypdf before they're encoded, they're reused across the
+// renders to reduce the GC pressure.
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// acquireBuffer returns an empty buffer from the pool, it must be given back with releaseBuffer once it's done.
+func acquireBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case FormatPNG, FormatWebP, FormatJPEG:
+		return true
+	default:
+		return false
+	}
+}
+
+// encode writes the page, rendered as PNG by lazypdf, in the given format. The quality is only used by JPEG, zero
+// means the default one.
+func encode(format string, quality int, page []byte, output io.Writer) error {
+	if format == FormatPNG {
+		_, err := output.Write(page)
+		return err
+	}
+
+	img, err := png.Decode(bytes.NewReader(page))
+	if err != nil {
+		return fmt.Errorf("fail to decode the PNG: %w", err)
+	}
+	return encodeImage(format, quality, img, output)
+}
+
+func encodeImage(format string, quality int, img image.Image, output io.Writer) error {
+	switch format {
+	case FormatPNG:
+		if err := png.Encode(output, img); err != nil {
+			return fmt.Errorf("fail to encode the PNG: %w", err)
+		}
+	case FormatWebP:
+		if err := webp.Encode(output, img, &webp.Options{Quality: webpQuality}); err != nil {
+			return fmt.Errorf("fail to encode the WebP: %w", err)
+		}
+	case FormatJPEG:
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		if err := jpeg.Encode(output, img, &jpeg.Options{Quality: quality}); err != nil {
+			return fmt.Errorf("fail to encode the JPEG: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported format '%s'", format)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// gcsPrefix identifies the documents stored at Google Cloud Storage, the path is 'gs://bucket/key'.
+const gcsPrefix = "gs://"
+
+func (w *Worker) fetchFileFromGCS(ctx context.Context, path string) (_ []byte, err error) {
+	span, ctx := ddTracer.StartSpanFromContext(ctx, "Worker.fetchFileFromGCS")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	fragments := strings.SplitN(strings.TrimPrefix(path, gcsPrefix), "/", 2)
+	if len(fragments) < 2 || fragments[0] == "" || fragments[1] == "" {
+		return nil, newClientError(errors.New("invalid path"))
+	}
+
+	reader, err := w.getGCSReader(ctx, fragments[0], fragments[1])
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+			return nil, newNotFoundError(err)
+		}
+		return nil, fmt.Errorf("fail to get object: %w", err)
+	}
+	defer reader.Close()
+
+	payload, err := w.readBody(reader)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read the reader: %w", err)
+	}
+	span.SetTag("fileSize", len(payload))
+
+	return payload, nil
+}
+
+// gcsObjectReader opens the object with a bucket handle from the cache. There is a single client for all the buckets,
+// it's created on the first use with the credentials from the environment, like GOOGLE_APPLICATION_CREDENTIALS.
+func (w *Worker) gcsObjectReader(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	w.mutex.Lock()
+	handle, ok := w.gcsBuckets[bucket]
+	if !ok {
+		if w.gcsClient == nil {
+			// The client outlives the request, so it can't use the request context.
+			client, err := storage.NewClient(context.Background())
+			if err != nil {
+				w.mutex.Unlock()
+				return nil, fmt.Errorf("fail to create the GCS client: %w", err)
+			}
+			w.gcsClient = client
+		}
+		handle = w.gcsClient.Bucket(bucket)
+		w.gcsBuckets[bucket] = handle
+	}
+	w.mutex.Unlock()
+
+	return handle.Object(key).NewReader(ctx)
+}
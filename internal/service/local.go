@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// localPrefix identifies the documents read from the LocalDir, the path is 'file://' followed by the file path relative
+// to the directory.
+const localPrefix = "file://"
+
+func (w *Worker) fetchFileFromLocal(ctx context.Context, path string) (_ []byte, err error) {
+	span, _ := ddTracer.StartSpanFromContext(ctx, "Worker.fetchFileFromLocal")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	if w.LocalDir == "" {
+		return nil, newClientError(errors.New("local files are disabled"))
+	}
+
+	// The segments can't use backslashes either, they're separators on Windows.
+	name := strings.TrimPrefix(path, localPrefix)
+	segments := strings.Split(name, "/")
+	if !validPathSegments(segments) || strings.Contains(name, `\`) {
+		return nil, newClientError(errors.New("invalid path"))
+	}
+
+	payload, err := os.ReadFile(filepath.Join(w.LocalDir, filepath.FromSlash(name)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, newNotFoundError(err)
+		}
+		return nil, fmt.Errorf("fail to read the file: %w", err)
+	}
+	span.SetTag("fileSize", len(payload))
+
+	return payload, nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// workerMetrics are the Prometheus collectors of the worker. They're always created to keep the instrumentation free
+// of checks, but they're only exposed when the worker has a MetricsRegisterer.
+type workerMetrics struct {
+	renderDuration *prometheus.HistogramVec
+	fetchDuration  *prometheus.HistogramVec
+}
+
+func newWorkerMetrics(registerer prometheus.Registerer) (workerMetrics, error) {
+	m := workerMetrics{
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lazyraster_render_duration_seconds",
+			Help:    "Duration of the page renders, including the encoding to the output format.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"format"}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lazyraster_fetch_duration_seconds",
+			Help:    "Duration of the documents download.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"source"}),
+	}
+	if registerer == nil {
+		return m, nil
+	}
+	for _, collector := range []prometheus.Collector{m.renderDuration, m.fetchDuration} {
+		if err := registerer.Register(collector); err != nil {
+			return workerMetrics{}, fmt.Errorf("fail to register the collector: %w", err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/nitro/lazypdf/v2"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+const (
+	// placeholderRenderWidth is the width the page is rasterized at, it's bigger than the placeholder to have enough
+	// pixels to average when downscaling.
+	placeholderRenderWidth = 64
+	placeholderWidth       = 16
+)
+
+// Placeholder generates a tiny and blurred version of the page to be displayed while the full page is loading. The
+// result is a PNG data URI.
+func (w *Worker) Placeholder(ctx context.Context, url, path string, page int) (_ string, err error) {
+	span, ctx := w.startSpan(ctx, "Worker.Placeholder")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	// Check Worker.Process for the reason of this change.
+	page--
+
+	if page < 0 {
+		return "", newClientError(errors.New("invalid page"))
+	}
+
+	if !w.validSignature(url) {
+		return "", newClientError(errors.New("invalid token"))
+	}
+
+	payload, err := w.fetchFile(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("fail to fetch the file: %w", err)
+	}
+	if err := w.checkDocumentPages(ctx, payload); err != nil {
+		return "", err
+	}
+
+	var storage bytes.Buffer
+	err = lazypdf.SaveToPNG(ctx, uint16(page), placeholderRenderWidth, 0, bytes.NewReader(payload), &storage)
+	if err != nil {
+		return "", fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+	}
+
+	img, err := png.Decode(&storage)
+	if err != nil {
+		return "", fmt.Errorf("fail to decode the PNG: %w", err)
+	}
+
+	var result bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&result, blur(downscale(img, placeholderWidth))); err != nil {
+		return "", fmt.Errorf("fail to encode the placeholder: %w", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(result.Bytes()), nil
+}
+
+// downscale the image to the given width keeping the aspect ratio. Each pixel is the average of the source pixels it
+// covers.
+func downscale(src image.Image, width int) *image.RGBA {
+	bounds := src.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height == 0 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			dst.Set(x, y, average(src, image.Rect(x0, y0, x1, y1)))
+		}
+	}
+	return dst
+}
+
+// blur applies a 3x3 box blur.
+func blur(src *image.RGBA) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dst.Set(x, y, average(src, image.Rect(x-1, y-1, x+2, y+2).Intersect(bounds)))
+		}
+	}
+	return dst
+}
+
+func average(src image.Image, area image.Rectangle) color.Color {
+	var r, g, b, a, count uint64
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			cr, cg, cb, ca := src.At(x, y).RGBA()
+			r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+			count++
+		}
+	}
+	if count == 0 {
+		return color.RGBA64{}
+	}
+	return color.RGBA64{
+		R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count),
+	}
+}
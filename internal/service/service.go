@@ -1,13 +1,15 @@
 package service
 
 import (
+	"context"
 	"errors"
 )
 
 // Sentinel errors.
 var (
-	ErrClient   = ServiceError{origin: "client"}
-	ErrNotFound = ServiceError{origin: "notFound"}
+	ErrClient      = ServiceError{origin: "client"}
+	ErrNotFound    = ServiceError{origin: "notFound"}
+	ErrUnavailable = ServiceError{origin: "unavailable"}
 )
 
 // ServiceError has detailed information about errors from the service package.
@@ -37,3 +39,21 @@ func newClientError(err error) error {
 func newNotFoundError(err error) error {
 	return ServiceError{base: err, origin: "notFound"}
 }
+
+func newUnavailableError(err error) error {
+	return ServiceError{base: err, origin: "unavailable"}
+}
+
+type bypassCacheKey struct{}
+
+// WithBypassCache flags the context to skip the cached documents, they're fetched again and the cache is refreshed
+// with the result.
+func WithBypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+// BypassingCache reports if the context was flagged by WithBypassCache.
+func BypassingCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassCacheKey{}).(bool)
+	return bypass
+}
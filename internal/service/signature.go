@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" // nolint: gosec
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The algorithms used to sign the URLs. SignatureSHA1 generates the same tokens as github.com/Nitro/urlsign, it's the
+// default to keep the existing URLs valid.
+const (
+	SignatureSHA1   = "sha1"
+	SignatureSHA256 = "sha256"
+)
+
+func signatureHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case SignatureSHA1:
+		return sha1.New, nil
+	case SignatureSHA256:
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm '%s'", algorithm)
+	}
+}
+
+// validSignature checks the URL token. When it's expired the check is done again as if it was TokenLeeway ago.
+func (w *Worker) validSignature(url string) bool {
+	now := time.Now()
+	if w.validSignatureAt(now, url) {
+		return true
+	}
+	return w.TokenLeeway > 0 && w.validSignatureAt(now.Add(-w.TokenLeeway), url)
+}
+
+// validSignatureAt accepts the tokens generated at the bucket of the given time and at the buckets before and after
+// it, so a token doesn't expire right after being generated when it's close to the bucket boundary.
+func (w *Worker) validSignatureAt(baseTime time.Time, rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	query := parsed.Query()
+	token := query.Get("token")
+	if token == "" {
+		return false
+	}
+
+	canonical := canonicalURL(parsed.Path, query)
+	for _, bucketTime := range []time.Time{
+		baseTime, baseTime.Add(-w.URLSigningBucketSize), baseTime.Add(w.URLSigningBucketSize),
+	} {
+		if hmac.Equal([]byte(token), []byte(w.generateToken(bucketTime, canonical))) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignURL returns the path and the query with the token that validSignature accepts. Only the first value of each
+// parameter is signed, so the others are dropped. Any token in the query is replaced.
+func (w *Worker) SignURL(path string, query url.Values) string {
+	signedQuery := url.Values{}
+	for key, values := range query {
+		if key != "token" && len(values) > 0 {
+			signedQuery.Set(key, values[0])
+		}
+	}
+	signedQuery.Set("token", w.generateToken(time.Now(), canonicalURL(path, signedQuery)))
+
+	signedURL := url.URL{Path: path, RawQuery: signedQuery.Encode()}
+	return signedURL.String()
+}
+
+// generateToken signs the URL with a secret derived from the URL signing secret and the bucket of the given time.
+func (w *Worker) generateToken(baseTime time.Time, canonicalURL string) string {
+	var bucket bytes.Buffer
+	_ = binary.Write(&bucket, binary.BigEndian, baseTime.UnixNano()/int64(w.URLSigningBucketSize))
+	timedSecret := hmac.New(w.signatureHash, []byte(w.URLSigningSecret))
+	timedSecret.Write(bucket.Bytes())
+
+	mac := hmac.New(w.signatureHash, timedSecret.Sum(nil))
+	mac.Write([]byte(canonicalURL))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalURL is the representation of the URL that is signed: the path followed by the first value of each parameter,
+// except the token, sorted and unescaped.
+func canonicalURL(path string, query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		if key != "token" && len(values) > 0 {
+			params = append(params, key+"="+values[0])
+		}
+	}
+	if len(params) == 0 {
+		return path
+	}
+	sort.Strings(params)
+	return path + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nitro/lazypdf/v2"
+	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+const (
+	// maxValidatePages bounds the work of a validation, every page of the document is rendered.
+	maxValidatePages          = 500
+	defaultValidateConcurrent = 4
+)
+
+// PageValidation is the result of rendering a page of the document. Error is empty when the page rendered.
+type PageValidation struct {
+	Page  int
+	Valid bool
+	Error string `json:",omitempty"`
+}
+
+// Validate renders every page of the document, discarding the output, and reports the pages that fail. The pages are
+// rendered with up to ValidateConcurrency at the same time.
+func (w *Worker) Validate(ctx context.Context, url, path string) (_ []PageValidation, err error) {
+	span, ctx := w.startSpan(ctx, "Worker.Validate")
+	defer func() { span.Finish(ddTracer.WithError(err)) }()
+
+	if !w.validSignature(url) {
+		return nil, newClientError(errors.New("invalid token"))
+	}
+
+	// The validation goes straight to the storage, it must not fill the document cache.
+	payload, err := w.fetchFileVersion(ctx, path, "")
+	if err != nil {
+		return nil, fmt.Errorf("fail to fetch the file: %w", err)
+	}
+
+	pageCount, err := lazypdf.PageCount(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("fail to count the file pages: %w", err)
+	}
+	if pageCount > maxValidatePages {
+		return nil, newClientError(fmt.Errorf("document has more than %d pages", maxValidatePages))
+	}
+	if err := w.checkPageCount(pageCount); err != nil {
+		return nil, err
+	}
+
+	var (
+		result    = make([]PageValidation, pageCount)
+		semaphore = make(chan struct{}, w.ValidateConcurrency)
+		wg        sync.WaitGroup
+	)
+	for page := 0; page < pageCount; page++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(page int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			// The page number is 1 based to match the other endpoints.
+			result[page] = PageValidation{Page: page + 1, Valid: true}
+			err := lazypdf.SaveToPNG(ctx, uint16(page), 0, 0, bytes.NewReader(payload), io.Discard)
+			if err != nil {
+				result[page].Valid = false
+				result[page].Error = err.Error()
+			}
+		}(page)
+	}
+	wg.Wait()
+
+	// The pages that failed because of the context are not a problem of the document.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -3,16 +3,22 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"image/color"
 	"io"
+	"math"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Nitro/urlsign"
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -20,12 +26,28 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/google/uuid"
 	"github.com/nitro/lazypdf/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	awstrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/aws/aws-sdk-go/aws"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	ddTracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+const (
+	defaultReadBufferSize = 32 * 1024
+	defaultMaxImageWidth  = 4096
+
+	// defaultURLSigningBucketSize is the window historically used by the URL signers.
+	defaultURLSigningBucketSize = 8 * time.Hour
+
+	// maxImageWidthLimit is the biggest width lazypdf accepts.
+	maxImageWidthLimit = math.MaxUint16
+
+	// pointsPerInch is the PDF user space unit, a page rendered with scale 1 has one pixel per point.
+	pointsPerInch = 72
+	maxScale      = 3
+)
+
 // Worker used to fetch and process PDF files.
 type Worker struct {
 	HTTPClient          *http.Client
@@ -34,9 +56,99 @@ type Worker struct {
 	TraceExtractor      func(context.Context, zerolog.Logger) (zerolog.Logger, error)
 	StorageBucketRegion map[string]string
 
+	// URLSigningBucketSize is the time window of the URL tokens, defaults to 8 hours. A token is accepted during its
+	// window and the ones before and after it, so shorter windows make shorter-lived URLs. The URL signers must use the
+	// same value.
+	URLSigningBucketSize time.Duration
+
+	// URLSigningAlgorithm is the hash of the URL tokens, SignatureSHA1 (default) or SignatureSHA256.
+	URLSigningAlgorithm string
+
+	// TokenLeeway extends the acceptance of the tokens beyond their expiration, to cope with the clock skew between the
+	// URL signers and the service. Zero means no leeway.
+	TokenLeeway time.Duration
+
+	// ReadBufferSize is the size of the buffer used to copy the documents from the storage into memory. Defaults to
+	// 32KB, the same size used by io.Copy.
+	ReadBufferSize int
+
+	// MaxOpenFiles bounds how many files are being downloaded at the same time, each one holding a file descriptor.
+	// When the limit is reached the request fails with ErrUnavailable instead of exhausting the process descriptors.
+	// Zero means unlimited.
+	MaxOpenFiles int
+
+	// DocumentCacheSize is the total size in bytes of the documents kept in memory between the requests, the least
+	// recently used ones are evicted to make room. Zero disables the cache.
+	DocumentCacheSize int
+
+	// MaxPageCount rejects the documents with more pages than this value. Zero means unlimited.
+	MaxPageCount int
+
+	// MaxImageWidth is the biggest width a page can be rendered with, defaults to 4096.
+	MaxImageWidth int
+
+	// MinWidth is the smallest width a page can be rendered with, defaults to 1. A lower width is rejected, or raised to
+	// MinWidth when ClampMinWidth is set. Requests without a width render the page at its natural size and aren't
+	// affected.
+	MinWidth      int
+	ClampMinWidth bool
+
+	// CoverWidth and CoverHeight are the size of the images rendered by Cover, the defaults follow the Open Graph
+	// recommendation of 1200x630. CoverBackground fills the area not covered by the page, as '#rrggbb'.
+	CoverWidth      int
+	CoverHeight     int
+	CoverBackground string
+
+	// ValidateConcurrency is the quantity of pages rendered at the same time by Validate, defaults to 4.
+	ValidateConcurrency int
+
+	// The Azure storage account used to read the 'azblob://' documents, either from the connection string or from the
+	// account name and key. Without them the Azure documents fail to be fetched.
+	AzureStorageConnectionString string
+	AzureStorageAccount          string
+	AzureStorageKey              string
+
+	// LocalDir enables the 'file://' documents, they're read from this directory. It's meant for local development and
+	// air-gapped deployments, any file under the directory can be rendered. Empty disables them.
+	LocalDir string
+
+	// MetricsRegisterer, when set, receives the Prometheus collectors of the render and download durations.
+	MetricsRegisterer prometheus.Registerer
+
+	signatureHash func() hash.Hash
+
 	getS3Client func(string) (s3iface.S3API, error)
 	s3Clients   map[string]s3iface.S3API
-	mutex       sync.Mutex
+
+	getGCSReader func(context.Context, string, string) (io.ReadCloser, error)
+	gcsClient    *storage.Client
+	gcsBuckets   map[string]*storage.BucketHandle
+
+	getAzureReader func(context.Context, string, string) (io.ReadCloser, error)
+	azureAccount   azureAccount
+	azureServices  map[string]azblob.ServiceURL
+	mutex          sync.Mutex
+	openFiles      chan struct{}
+
+	documentCache *documentCache
+	fetches       callGroup
+	renders       callGroup
+
+	coverBackground color.RGBA
+	metrics         workerMetrics
+}
+
+// WorkerStats is a snapshot of the worker resources usage.
+type WorkerStats struct {
+	// S3Clients is the quantity of S3 clients cached, there is one per region.
+	S3Clients int
+
+	// OpenFiles is the quantity of files being downloaded.
+	OpenFiles int
+
+	// CachedDocuments is the quantity of documents in the cache and CacheSize their total size in bytes.
+	CachedDocuments int
+	CacheSize       int
 }
 
 // Init worker internal state.
@@ -53,15 +165,120 @@ func (w *Worker) Init() error {
 	if len(w.StorageBucketRegion) == 0 {
 		return errors.New("internal/service/Worker.StorageBucketRegion can't be empty")
 	}
+	if w.URLSigningBucketSize < 0 {
+		return errors.New("internal/service/Worker.URLSigningBucketSize can't be negative")
+	} else if w.URLSigningBucketSize == 0 {
+		w.URLSigningBucketSize = defaultURLSigningBucketSize
+	}
+	if w.URLSigningAlgorithm == "" {
+		w.URLSigningAlgorithm = SignatureSHA1
+	}
+	hashFunc, err := signatureHash(w.URLSigningAlgorithm)
+	if err != nil {
+		return fmt.Errorf("internal/service/Worker.URLSigningAlgorithm is invalid: %w", err)
+	}
+	w.signatureHash = hashFunc
+	if w.TokenLeeway < 0 {
+		return errors.New("internal/service/Worker.TokenLeeway can't be negative")
+	}
+	if w.ReadBufferSize < 0 {
+		return errors.New("internal/service/Worker.ReadBufferSize can't be negative")
+	} else if w.ReadBufferSize == 0 {
+		w.ReadBufferSize = defaultReadBufferSize
+	}
+	if w.MaxOpenFiles < 0 {
+		return errors.New("internal/service/Worker.MaxOpenFiles can't be negative")
+	} else if w.MaxOpenFiles > 0 {
+		w.openFiles = make(chan struct{}, w.MaxOpenFiles)
+	}
+	if w.DocumentCacheSize < 0 {
+		return errors.New("internal/service/Worker.DocumentCacheSize can't be negative")
+	} else if w.DocumentCacheSize > 0 {
+		w.documentCache = newDocumentCache(w.DocumentCacheSize)
+	}
+	if w.MaxPageCount < 0 {
+		return errors.New("internal/service/Worker.MaxPageCount can't be negative")
+	}
+	if w.MaxImageWidth < 0 || w.MaxImageWidth > maxImageWidthLimit {
+		return fmt.Errorf("internal/service/Worker.MaxImageWidth must be between 0 and %d", maxImageWidthLimit)
+	} else if w.MaxImageWidth == 0 {
+		w.MaxImageWidth = defaultMaxImageWidth
+	}
+	if w.MinWidth < 0 {
+		return errors.New("internal/service/Worker.MinWidth can't be negative")
+	} else if w.MinWidth == 0 {
+		w.MinWidth = 1
+	}
+	if w.CoverWidth < 0 || w.CoverWidth > w.MaxImageWidth {
+		return fmt.Errorf("internal/service/Worker.CoverWidth must be between 0 and %d", w.MaxImageWidth)
+	} else if w.CoverWidth == 0 {
+		w.CoverWidth = defaultCoverWidth
+	}
+	if w.CoverHeight < 0 || w.CoverHeight > maxCoverHeight {
+		return fmt.Errorf("internal/service/Worker.CoverHeight must be between 0 and %d", maxCoverHeight)
+	} else if w.CoverHeight == 0 {
+		w.CoverHeight = defaultCoverHeight
+	}
+	if w.CoverBackground == "" {
+		w.CoverBackground = defaultCoverBackground
+	}
+	coverBackground, err := parseHexColor(w.CoverBackground)
+	if err != nil {
+		return fmt.Errorf("internal/service/Worker.CoverBackground is invalid: %w", err)
+	}
+	w.coverBackground = coverBackground
+	if w.ValidateConcurrency < 0 {
+		return errors.New("internal/service/Worker.ValidateConcurrency can't be negative")
+	} else if w.ValidateConcurrency == 0 {
+		w.ValidateConcurrency = defaultValidateConcurrent
+	}
 	if w.getS3Client == nil {
 		w.getS3Client = w.getBucketS3Client
 	}
 	w.s3Clients = make(map[string]s3iface.S3API)
+	if w.getGCSReader == nil {
+		w.getGCSReader = w.gcsObjectReader
+	}
+	w.gcsBuckets = make(map[string]*storage.BucketHandle)
+	w.azureAccount, err = parseAzureAccount(w.AzureStorageConnectionString, w.AzureStorageAccount, w.AzureStorageKey)
+	if err != nil {
+		return fmt.Errorf("internal/service/Worker.AzureStorageConnectionString is invalid: %w", err)
+	}
+	if w.getAzureReader == nil {
+		w.getAzureReader = w.azureBlobReader
+	}
+	w.azureServices = make(map[string]azblob.ServiceURL)
+	if w.metrics, err = newWorkerMetrics(w.MetricsRegisterer); err != nil {
+		return fmt.Errorf("internal/service/Worker.MetricsRegisterer is invalid: %w", err)
+	}
 	return nil
 }
 
+// Render describes how a page is rendered, once the defaults and the limits are applied to the requested parameters.
+// The page starts at 1.
+type Render struct {
+	Page    int
+	Width   int
+	Scale   float32
+	Format  string
+	Quality int
+
+	// Version identifies the content of the document, it changes when the document is changed at the storage.
+	Version string
+}
+
+// RenderObserver can be implemented by the output of Process and Cover to know how the page is rendered before it's
+// written. The render is skipped when Rendering returns false, like when the client already has the page.
+type RenderObserver interface {
+	Rendering(Render) bool
+}
+
+// Process renders the page in the given format, FormatPNG, FormatWebP or FormatJPEG. The quality, from 1 to 100, is
+// only used by JPEG and zero means the default one. When the output is a RenderObserver it's told how the page is
+// rendered before the render starts.
 func (w *Worker) Process(
-	ctx context.Context, url, path string, page int, width int, scale float32, output io.Writer,
+	ctx context.Context, url, path string, page int, width int, scale float32, format string, quality int,
+	output io.Writer,
 ) (err error) {
 	span, ctx := w.startSpan(ctx, "Worker.Process")
 	defer func() { span.Finish(ddTracer.WithError(err)) }()
@@ -73,47 +290,111 @@ func (w *Worker) Process(
 		return newClientError(errors.New("invalid page"))
 	}
 
-	if width < 0 {
-		return newClientError(errors.New("invalid width"))
-	} else if width > 4096 {
-		return newClientError(errors.New("invalid width, can't be bigger than 4096"))
+	width, err = w.checkWidth(width)
+	if err != nil {
+		return err
 	}
 
 	if scale < 0 {
 		return newClientError(errors.New("invalid scale"))
-	} else if scale > 3 {
+	} else if scale > maxScale {
 		return newClientError(errors.New("invalid scale, can't be bigger than 3"))
 	}
 
-	if !urlsign.IsValidSignature(w.URLSigningSecret, 8*time.Hour, time.Now(), url) {
+	if !validFormat(format) {
+		return newClientError(fmt.Errorf("invalid format '%s'", format))
+	}
+
+	if quality < 0 || quality > maxJPEGQuality {
+		return newClientError(fmt.Errorf("invalid quality, must be between 1 and %d", maxJPEGQuality))
+	} else if format != FormatJPEG {
+		quality = 0
+	} else if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+
+	if !w.validSignature(url) {
 		return newClientError(errors.New("invalid token"))
 	}
 
-	payload, err := w.fetchFile(ctx, path)
+	doc, err := w.fetchDocument(ctx, path)
 	if err != nil {
 		return fmt.Errorf("fail to fetch the file: %w", err)
 	}
 
-	storage := bytes.NewBuffer([]byte{})
-	err = lazypdf.SaveToPNG(ctx, uint16(page), uint16(width), scale, bytes.NewBuffer(payload), storage)
-	if err != nil {
-		return fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+	render := Render{Page: page + 1, Width: width, Scale: scale, Format: format, Quality: quality, Version: doc.version}
+	if observer, ok := output.(RenderObserver); ok && !observer.Rendering(render) {
+		return nil
 	}
-	result := io.NopCloser(storage)
-	defer result.Close()
 
-	if _, err := io.Copy(output, result); err != nil {
+	// The concurrent requests of the same render share its result, so a popular document is rendered once. The version
+	// keeps the requests that fetched a changed document from sharing the render of the previous one.
+	key := fmt.Sprintf("%s|%s|%d|%d|%g|%s|%d", path, doc.version, page, width, scale, format, quality)
+	result, err := w.renders.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return w.render(ctx, doc.payload, page, width, scale, format, quality)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := output.Write(result.([]byte)); err != nil {
 		return fmt.Errorf("fail write the result to the output: %w", err)
 	}
 	return nil
 }
 
+// render renders the page of the document, the page starts at zero.
+func (w *Worker) render(
+	ctx context.Context, payload []byte, page int, width int, scale float32, format string, quality int,
+) (_ []byte, err error) {
+	if err := w.checkDocumentPages(ctx, payload); err != nil {
+		return nil, err
+	}
+
+	// The other formats are encoded from the PNG.
+	renderStart := time.Now()
+	var result bytes.Buffer
+	if format == FormatPNG {
+		err = lazypdf.SaveToPNG(ctx, uint16(page), uint16(width), scale, bytes.NewReader(payload), &result)
+		if err != nil {
+			return nil, fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+		}
+	} else {
+		storage := acquireBuffer()
+		defer releaseBuffer(storage)
+		err = lazypdf.SaveToPNG(ctx, uint16(page), uint16(width), scale, bytes.NewReader(payload), storage)
+		if err != nil {
+			return nil, fmt.Errorf("fail to extract the PNG from the PDF: %w", err)
+		}
+		if err := encode(format, quality, storage.Bytes(), &result); err != nil {
+			return nil, fmt.Errorf("fail write the result to the output: %w", err)
+		}
+	}
+	w.metrics.renderDuration.WithLabelValues(format).Observe(time.Since(renderStart).Seconds())
+	return result.Bytes(), nil
+}
+
+// DPIScale returns the scale that renders the page at its natural size with the given resolution. The resolution is
+// bounded by the maximum scale, which keeps the pixel budget of the page the same as an explicit scale. Zero returns
+// the zero scale, so lazypdf renders with its default of 1.5, or 1 for the landscape pages.
+func DPIScale(dpi int) (float32, error) {
+	if dpi < 0 {
+		return 0, newClientError(errors.New("invalid dpi"))
+	} else if dpi == 0 {
+		return 0, nil
+	}
+	scale := float32(dpi) / pointsPerInch
+	if scale > maxScale {
+		return 0, newClientError(fmt.Errorf("invalid dpi, can't be bigger than %d", maxScale*pointsPerInch))
+	}
+	return scale, nil
+}
+
 // Metadata is used to fetch the document metadata.
 func (w *Worker) Metadata(ctx context.Context, url, path string) (_ string, _ int, err error) {
 	span, ctx := w.startSpan(ctx, "Worker.Metadata")
 	defer func() { span.Finish(ddTracer.WithError(err)) }()
 
-	if !urlsign.IsValidSignature(w.URLSigningSecret, 8*time.Hour, time.Now(), url) {
+	if !w.validSignature(url) {
 		return "", 0, newClientError(errors.New("invalid token"))
 	}
 
@@ -126,20 +407,161 @@ func (w *Worker) Metadata(ctx context.Context, url, path string) (_ string, _ in
 	if err != nil {
 		return "", 0, fmt.Errorf("fail to count the file pages: %w", err)
 	}
+	if err := w.checkPageCount(pageCount); err != nil {
+		return "", 0, err
+	}
 
 	return w.generateFilename(), pageCount, nil
 }
 
-func (w *Worker) fetchFile(ctx context.Context, path string) (_ []byte, err error) {
+func (w *Worker) checkPageCount(pageCount int) error {
+	if w.MaxPageCount > 0 && pageCount > w.MaxPageCount {
+		return newClientError(fmt.Errorf("document has too many pages, can't be more than %d", w.MaxPageCount))
+	}
+	return nil
+}
+
+// document is a fetched file and the version of its content.
+type document struct {
+	payload []byte
+	version string
+}
+
+// newDocument derives the version from the content, so it's the same for every storage and doesn't require another
+// request to it.
+func newDocument(payload []byte) document {
+	sum := sha256.Sum256(payload)
+	return document{payload: payload, version: hex.EncodeToString(sum[:16])}
+}
+
+// checkWidth validates the width of a render, the widths below MinWidth are raised to it when ClampMinWidth is set.
+// Zero is kept, the width then follows the scale. Every render entry point goes through it, so they share the limits.
+func (w *Worker) checkWidth(width int) (int, error) {
+	if width < 0 {
+		return 0, newClientError(errors.New("invalid width"))
+	} else if width > w.MaxImageWidth {
+		return 0, newClientError(fmt.Errorf("invalid width, can't be bigger than %d", w.MaxImageWidth))
+	} else if width > 0 && width < w.MinWidth {
+		if !w.ClampMinWidth {
+			return 0, newClientError(fmt.Errorf("invalid width, can't be smaller than %d", w.MinWidth))
+		}
+		return w.MinWidth, nil
+	}
+	return width, nil
+}
+
+// checkDocumentPages applies MaxPageCount to the document, the pages are only counted when there is a limit.
+func (w *Worker) checkDocumentPages(ctx context.Context, payload []byte) error {
+	if w.MaxPageCount == 0 {
+		return nil
+	}
+	pageCount, err := lazypdf.PageCount(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("fail to count the file pages: %w", err)
+	}
+	return w.checkPageCount(pageCount)
+}
+
+// fetchFile fetches the latest version of the file, from the document cache when it's enabled.
+func (w *Worker) fetchFile(ctx context.Context, path string) ([]byte, error) {
+	if w.documentCache == nil {
+		return w.fetchFileVersion(ctx, path, "")
+	}
+	doc, err := w.documentCache.get(ctx, path, w.fetchLatest)
+	return doc.payload, err
+}
+
+// fetchDocument fetches the latest version of the file with the version of its content, from the document cache when
+// it's enabled. Without the cache the concurrent fetches of the same file are coalesced, and they share the version
+// computed once by the fetch.
+func (w *Worker) fetchDocument(ctx context.Context, path string) (document, error) {
+	if w.documentCache != nil {
+		return w.documentCache.get(ctx, path, w.fetchLatest)
+	}
+	key := fmt.Sprintf("%s|%t", path, BypassingCache(ctx))
+	result, err := w.fetches.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		payload, err := w.fetchLatest(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return newDocument(payload), nil
+	})
+	if err != nil {
+		return document{}, err
+	}
+	return result.(document), nil
+}
+
+func (w *Worker) fetchLatest(ctx context.Context, path string) ([]byte, error) {
+	return w.fetchFileVersion(ctx, path, "")
+}
+
+// fetchFileVersion fetches a specific version of the file, an empty version means the latest one. Only S3 supports
+// versions. The path is 'bucket/key' for S3, 'dropbox/' followed by the encoded file URL for Dropbox and
+// 'gs://bucket/key' for Google Cloud Storage, 'azblob://container/blob' for Azure Blob Storage and 'file://' followed by
+// the path relative to the LocalDir for the local files.
+func (w *Worker) fetchFileVersion(ctx context.Context, path, version string) (result []byte, err error) {
 	span, ctx := ddTracer.StartSpanFromContext(ctx, "Worker.fetchFile")
 	defer func() { span.Finish(ddTracer.WithError(err)) }()
 
+	if w.openFiles != nil {
+		select {
+		case w.openFiles <- struct{}{}:
+			defer func() { <-w.openFiles }()
+		default:
+			return nil, newUnavailableError(errors.New("too many open files"))
+		}
+	}
+
+	// Only the successful downloads are measured, the failures are usually rejected way before the download ends.
+	fetchStart, source := time.Now(), "s3"
+	defer func() {
+		if err == nil {
+			w.metrics.fetchDuration.WithLabelValues(source).Observe(time.Since(fetchStart).Seconds())
+		}
+	}()
+
+	// lazypdf panics with an empty document, so it's rejected whatever the storage it came from.
+	defer func() {
+		if err == nil && len(result) == 0 {
+			result, err = nil, newClientError(errors.New("empty document"))
+		}
+	}()
+
 	if strings.HasPrefix(path, "dropbox/") {
+		if version != "" {
+			return nil, newClientError(errors.New("dropbox files don't support versions"))
+		}
+		source = "dropbox"
 		return w.fetchFileFromDropbox(ctx, path)
 	}
 
+	if strings.HasPrefix(path, gcsPrefix) {
+		if version != "" {
+			return nil, newClientError(errors.New("gcs files don't support versions"))
+		}
+		source = "gcs"
+		return w.fetchFileFromGCS(ctx, path)
+	}
+
+	if strings.HasPrefix(path, localPrefix) {
+		if version != "" {
+			return nil, newClientError(errors.New("local files don't support versions"))
+		}
+		source = "local"
+		return w.fetchFileFromLocal(ctx, path)
+	}
+
+	if strings.HasPrefix(path, azurePrefix) {
+		if version != "" {
+			return nil, newClientError(errors.New("azure files don't support versions"))
+		}
+		source = "azure"
+		return w.fetchFileFromAzure(ctx, path)
+	}
+
 	fragments := strings.Split(path, "/")
-	if len(fragments) < 2 {
+	if len(fragments) < 2 || !validPathSegments(fragments) {
 		return nil, newClientError(errors.New("invalid path"))
 	}
 	bucket := fragments[0]
@@ -149,10 +571,14 @@ func (w *Worker) fetchFile(ctx context.Context, path string) (_ []byte, err erro
 		return nil, fmt.Errorf("fail to get the s3 bucket client: %w", err)
 	}
 
-	output, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+	input := s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    aws.String(strings.Join(fragments[1:], "/")),
-	})
+	}
+	if version != "" {
+		input.VersionId = &version
+	}
+	output, err := s3Client.GetObjectWithContext(ctx, &input)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == s3.ErrCodeNoSuchKey) {
 			return nil, newNotFoundError(err)
@@ -161,7 +587,7 @@ func (w *Worker) fetchFile(ctx context.Context, path string) (_ []byte, err erro
 	}
 	defer output.Body.Close()
 
-	payload, err := io.ReadAll(output.Body)
+	payload, err := w.readBody(output.Body)
 	if err != nil {
 		return nil, fmt.Errorf("fail to read the reader: %w", err)
 	}
@@ -170,11 +596,35 @@ func (w *Worker) fetchFile(ctx context.Context, path string) (_ []byte, err erro
 	return payload, nil
 }
 
+// validPathSegments checks that every segment of the path is a plain name. The empty and relative segments are
+// rejected, they could make the path reach another file once it's normalized.
+func validPathSegments(segments []string) bool {
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// readBody copies the body using a buffer of ReadBufferSize. The reader and the writer are wrapped to hide the
+// io.WriterTo and io.ReaderFrom implementations, otherwise io.CopyBuffer would ignore the given buffer.
+func (w *Worker) readBody(body io.Reader) ([]byte, error) {
+	var result bytes.Buffer
+	_, err := io.CopyBuffer(
+		struct{ io.Writer }{&result}, struct{ io.Reader }{body}, make([]byte, w.ReadBufferSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
 func (w *Worker) fetchFileFromDropbox(ctx context.Context, path string) (_ []byte, err error) {
 	span, ctx := ddTracer.StartSpanFromContext(ctx, "Worker.fetchFileFromDropbox")
 	defer func() { span.Finish(ddTracer.WithError(err)) }()
 
-	fileURL, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(path, "dropbox/"))
+	fileURL, err := decodeDropboxPath(strings.TrimPrefix(path, "dropbox/"))
 	if err != nil {
 		return nil, newClientError(fmt.Errorf("fail to decode base64 path: %w", err))
 	}
@@ -204,6 +654,49 @@ func (w *Worker) fetchFileFromDropbox(ctx context.Context, path string) (_ []byt
 	return payload, nil
 }
 
+// decodeDropboxPath decodes the file URL. The URL should be encoded with the URL safe alphabet, but the standard one is
+// accepted as well as some clients use it.
+func decodeDropboxPath(encoded string) ([]byte, error) {
+	result, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		return result, nil
+	}
+	if result, stdErr := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "=")); stdErr == nil {
+		return result, nil
+	}
+	return nil, err
+}
+
+// Stats returns the current usage of the worker resources.
+func (w *Worker) Stats() WorkerStats {
+	var stats WorkerStats
+	if w.documentCache != nil {
+		stats.CachedDocuments, stats.CacheSize = w.documentCache.stats()
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	stats.S3Clients, stats.OpenFiles = len(w.s3Clients), len(w.openFiles)
+	return stats
+}
+
+// CachedDocuments lists the documents at the cache, the most recently used first.
+func (w *Worker) CachedDocuments() []CachedDocument {
+	if w.documentCache == nil {
+		return []CachedDocument{}
+	}
+	return w.documentCache.list()
+}
+
+// PurgeCache removes the document from the cache, or every document when the path is empty. It returns the quantity
+// of documents removed.
+func (w *Worker) PurgeCache(path string) int {
+	if w.documentCache == nil {
+		return 0
+	}
+	return w.documentCache.purge(path)
+}
+
 func (*Worker) generateFilename() string {
 	id := uuid.New()
 	return id.String() + "/document.pdf"
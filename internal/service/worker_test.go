@@ -3,19 +3,31 @@ package service
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Nitro/urlsign"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -36,6 +48,7 @@ func TestWorkerProcess(t *testing.T) {
 		page          int
 		width         int
 		scale         float32
+		format        string
 		s3Client      func(*testing.T) *mockS3
 		expectedError string
 	}{
@@ -73,6 +86,12 @@ func TestWorkerProcess(t *testing.T) {
 			scale:         4,
 			expectedError: "invalid scale, can't be bigger than 3",
 		},
+		{
+			message:       "have an invalid format",
+			page:          1,
+			format:        "gif",
+			expectedError: "invalid format 'gif'",
+		},
 		{
 			message:       "have an invalid token #1",
 			page:          1,
@@ -141,7 +160,7 @@ func TestWorkerProcess(t *testing.T) {
 				client.On("GetObjectWithContext", mock.Anything, &input).Return(&output, nil)
 				return &client
 			},
-			expectedError: "fail to extract the PNG from the PDF: failure at the C/MuPDF layer: cannot tell in file",
+			expectedError: "fail to fetch the file: empty document",
 		},
 		{
 			message: "process and return a page",
@@ -161,8 +180,28 @@ func TestWorkerProcess(t *testing.T) {
 				return &client
 			},
 		},
+		{
+			message: "process and return a page as WebP",
+			page:    1,
+			url:     fmt.Sprintf("documents?token=%s", validToken),
+			path:    "bucket-1/file.pdf",
+			format:  FormatWebP,
+			s3Client: func(t *testing.T) *mockS3 {
+				var client mockS3
+				input := s3.GetObjectInput{
+					Bucket: aws.String("bucket-1"),
+					Key:    aws.String("file.pdf"),
+				}
+				payload, err := os.ReadFile("testdata/sample.pdf")
+				require.NoError(t, err)
+				output := s3.GetObjectOutput{Body: io.NopCloser(bytes.NewBuffer(payload))}
+				client.On("GetObjectWithContext", mock.Anything, &input).Return(&output, nil)
+				return &client
+			},
+		},
 	}
 	for _, tt := range tests {
+		tt := tt
 		t.Run("Should "+tt.message, func(t *testing.T) {
 			t.Parallel()
 
@@ -186,27 +225,1453 @@ func TestWorkerProcess(t *testing.T) {
 				getS3Client:         getS3Client,
 			}
 			require.NoError(t, w.Init())
-			err := w.Process(context.Background(), tt.url, tt.path, tt.page, tt.width, tt.scale, bytes.NewBuffer([]byte{}))
+			format := tt.format
+			if format == "" {
+				format = FormatPNG
+			}
+			output := bytes.NewBuffer([]byte{})
+			err := w.Process(context.Background(), tt.url, tt.path, tt.page, tt.width, tt.scale, format, 0, output)
 			require.Equal(t, tt.expectedError == "", err == nil)
 			if tt.expectedError != "" {
 				require.Equal(t, tt.expectedError, err.Error())
+				return
 			}
+			_, decodedFormat, err := image.DecodeConfig(output)
+			require.NoError(t, err)
+			require.Equal(t, format, decodedFormat)
 		})
 	}
 }
 
-type mockS3 struct {
-	s3iface.S3API
-	mock.Mock
+func TestWorkerFetchFileOpenFilesLimit(t *testing.T) {
+	t.Parallel()
+
+	var (
+		client  mockS3
+		started = make(chan struct{})
+		finish  = make(chan struct{})
+		payload = []byte("payload")
+	)
+	defer client.AssertExpectations(t)
+	client.
+		On("GetObjectWithContext", mock.Anything, mock.Anything).
+		Run(func(mock.Arguments) {
+			started <- struct{}{}
+			<-finish
+		}).
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil).
+		Once()
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		MaxOpenFiles:        1,
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	result := make(chan error)
+	go func() {
+		_, err := w.fetchFile(context.Background(), "bucket-1/file.pdf")
+		result <- err
+	}()
+	<-started
+
+	_, err := w.fetchFile(context.Background(), "bucket-1/file.pdf")
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	close(finish)
+	require.NoError(t, <-result)
 }
 
-func (m *mockS3) GetObjectWithContext(
-	ctx context.Context, input *s3.GetObjectInput, options ...request.Option,
-) (*s3.GetObjectOutput, error) {
-	args := m.Called(ctx, input)
-	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+func TestWorkerFetchFileS3Path(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		path          string
+		expectedKey   string
+		expectedError error
+	}{
+		{message: "fetch a nested key", path: "bucket-1/folder/file.pdf", expectedKey: "folder/file.pdf"},
+		{message: "reject a parent segment", path: "bucket-1/folder/../secret.pdf", expectedError: ErrClient},
+		{message: "reject a current segment", path: "bucket-1/./file.pdf", expectedError: ErrClient},
+		{message: "reject a double slash", path: "bucket-1/folder//file.pdf", expectedError: ErrClient},
+		{message: "reject a leading slash at the key", path: "bucket-1//file.pdf", expectedError: ErrClient},
+		{message: "reject a leading slash at the path", path: "/bucket-1/file.pdf", expectedError: ErrClient},
+		{message: "reject a trailing slash", path: "bucket-1/folder/", expectedError: ErrClient},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var client mockS3
+			defer client.AssertExpectations(t)
+			if tt.expectedError == nil {
+				input := s3.GetObjectInput{Bucket: aws.String("bucket-1"), Key: aws.String(tt.expectedKey)}
+				client.
+					On("GetObjectWithContext", mock.Anything, &input).
+					Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("payload"))}, nil).
+					Once()
+			}
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+			}
+			require.NoError(t, w.Init())
+
+			payload, err := w.fetchFile(context.Background(), tt.path)
+			if tt.expectedError != nil {
+				require.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "payload", string(payload))
+		})
+	}
 }
 
-func traceExtractor(context.Context, zerolog.Logger) (zerolog.Logger, error) {
-	return zerolog.Nop(), nil
+func TestWorkerFetchFileGCS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		path          string
+		reader        func(bucket, key string) (io.ReadCloser, error)
+		expectedError error
+	}{
+		{
+			message: "fetch the object from the bucket",
+			path:    "gs://bucket-1/folder/file.pdf",
+			reader: func(bucket, key string) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(bucket + " " + key)), nil
+			},
+		},
+		{
+			message: "map a missing object to not found",
+			path:    "gs://bucket-1/folder/file.pdf",
+			reader: func(string, string) (io.ReadCloser, error) {
+				return nil, fmt.Errorf("fail: %w", storage.ErrObjectNotExist)
+			},
+			expectedError: ErrNotFound,
+		},
+		{
+			message:       "reject a path without the key",
+			path:          "gs://bucket-1",
+			expectedError: ErrClient,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				getGCSReader: func(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+					return tt.reader(bucket, key)
+				},
+			}
+			require.NoError(t, w.Init())
+
+			payload, err := w.fetchFile(context.Background(), tt.path)
+			if tt.expectedError != nil {
+				require.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "bucket-1 folder/file.pdf", string(payload))
+		})
+	}
+}
+
+func TestWorkerFetchFileAzure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		path          string
+		reader        func(container, blob string) (io.ReadCloser, error)
+		expectedError error
+	}{
+		{
+			message: "fetch the blob from the container",
+			path:    "azblob://container-1/folder/file.pdf",
+			reader: func(container, blob string) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(container + " " + blob)), nil
+			},
+		},
+		{
+			message: "map a missing blob to not found",
+			path:    "azblob://container-1/folder/file.pdf",
+			reader: func(string, string) (io.ReadCloser, error) {
+				return nil, mockAzureStorageError{serviceCode: azblob.ServiceCodeBlobNotFound}
+			},
+			expectedError: ErrNotFound,
+		},
+		{
+			message:       "reject a path without the blob",
+			path:          "azblob://container-1",
+			expectedError: ErrClient,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:                   http.DefaultClient,
+				URLSigningSecret:             "secret",
+				TraceExtractor:               traceExtractor,
+				StorageBucketRegion:          map[string]string{"bucket-1": "eu-central-1"},
+				AzureStorageConnectionString: "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=a2V5",
+				getAzureReader: func(_ context.Context, container, blob string) (io.ReadCloser, error) {
+					return tt.reader(container, blob)
+				},
+			}
+			require.NoError(t, w.Init())
+			require.Equal(t, "https://account.blob.core.windows.net", w.azureAccount.endpoint.String())
+
+			payload, err := w.fetchFile(context.Background(), tt.path)
+			if tt.expectedError != nil {
+				require.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "container-1 folder/file.pdf", string(payload))
+		})
+	}
+}
+
+func TestWorkerFetchFileLocal(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "folder"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "folder", "file.pdf"), []byte("local file"), 0o600))
+
+	tests := []struct {
+		message         string
+		localDir        string
+		path            string
+		expectedPayload string
+		expectedError   error
+	}{
+		{
+			message:         "read the file from the directory",
+			localDir:        dir,
+			path:            "file://folder/file.pdf",
+			expectedPayload: "local file",
+		},
+		{
+			message:       "return not found when the file doesn't exist",
+			localDir:      dir,
+			path:          "file://folder/missing.pdf",
+			expectedError: ErrNotFound,
+		},
+		{
+			message:       "reject a path outside of the directory",
+			localDir:      filepath.Join(dir, "folder"),
+			path:          "file://../folder/file.pdf",
+			expectedError: ErrClient,
+		},
+		{
+			message:       "reject a path that goes back and forth",
+			localDir:      dir,
+			path:          "file://folder/../folder/file.pdf",
+			expectedError: ErrClient,
+		},
+		{
+			message:       "reject an absolute path",
+			localDir:      dir,
+			path:          "file:///folder/file.pdf",
+			expectedError: ErrClient,
+		},
+		{
+			message:       "reject the local files when they're disabled",
+			path:          "file://folder/file.pdf",
+			expectedError: ErrClient,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				LocalDir:            tt.localDir,
+			}
+			require.NoError(t, w.Init())
+
+			payload, err := w.fetchFile(context.Background(), tt.path)
+			if tt.expectedError != nil {
+				require.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedPayload, string(payload))
+		})
+	}
+}
+
+func TestWorkerDocumentCache(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fetches = make(map[string]int)
+		mutex   sync.Mutex
+	)
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		DocumentCacheSize:   10,
+		getGCSReader: func(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fetches[key]++
+			if key == "missing.pdf" {
+				return nil, storage.ErrObjectNotExist
+			}
+			return io.NopCloser(strings.NewReader(fmt.Sprintf("%s-%d", key[:3], fetches[key]))), nil
+		},
+	}
+	require.NoError(t, w.Init())
+
+	fetch := func(ctx context.Context, path string) string {
+		payload, err := w.fetchFile(ctx, "gs://bucket-1/"+path)
+		require.NoError(t, err)
+		return string(payload)
+	}
+
+	// The cached document is reused until it's bypassed, then the fresh one replaces it.
+	require.Equal(t, "aaa-1", fetch(context.Background(), "aaa.pdf"))
+	require.Equal(t, "aaa-1", fetch(context.Background(), "aaa.pdf"))
+	require.Equal(t, "aaa-2", fetch(WithBypassCache(context.Background()), "aaa.pdf"))
+	require.Equal(t, "aaa-2", fetch(context.Background(), "aaa.pdf"))
+
+	// The cache fits two documents, the least recently used one is evicted.
+	require.Equal(t, "bbb-1", fetch(context.Background(), "bbb.pdf"))
+	require.Equal(t, "aaa-2", fetch(context.Background(), "aaa.pdf"))
+	require.Equal(t, "ccc-1", fetch(context.Background(), "ccc.pdf"))
+	require.Equal(t, "aaa-2", fetch(context.Background(), "aaa.pdf"))
+	require.Equal(t, "bbb-2", fetch(context.Background(), "bbb.pdf"))
+
+	stats := w.Stats()
+	require.Equal(t, 2, stats.CachedDocuments)
+	require.Equal(t, 10, stats.CacheSize)
+
+	require.Equal(t, []CachedDocument{
+		{Path: "gs://bucket-1/bbb.pdf", Size: 5}, {Path: "gs://bucket-1/aaa.pdf", Size: 5},
+	}, w.CachedDocuments())
+	require.Equal(t, 1, w.PurgeCache("gs://bucket-1/bbb.pdf"))
+	require.Equal(t, 0, w.PurgeCache("gs://bucket-1/bbb.pdf"))
+	require.Equal(t, "bbb-3", fetch(context.Background(), "bbb.pdf"))
+	require.Equal(t, 2, w.PurgeCache(""))
+	require.Empty(t, w.CachedDocuments())
+	require.Equal(t, "aaa-3", fetch(context.Background(), "aaa.pdf"))
+
+	// The failures aren't cached.
+	for i := 0; i < 2; i++ {
+		_, err := w.fetchFile(context.Background(), "gs://bucket-1/missing.pdf")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.Equal(t, 2, fetches["missing.pdf"])
+}
+
+func TestWorkerDocumentCacheCoalesce(t *testing.T) {
+	t.Parallel()
+
+	var (
+		started = make(chan struct{})
+		finish  = make(chan struct{})
+		fetches int32
+	)
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		DocumentCacheSize:   1024,
+		getGCSReader: func(context.Context, string, string) (io.ReadCloser, error) {
+			if atomic.AddInt32(&fetches, 1) == 1 {
+				close(started)
+			}
+			<-finish
+			return io.NopCloser(strings.NewReader("payload")), nil
+		},
+	}
+	require.NoError(t, w.Init())
+
+	results := make(chan []byte)
+	for i := 0; i < 5; i++ {
+		go func() {
+			payload, err := w.fetchFile(context.Background(), "gs://bucket-1/file.pdf")
+			require.NoError(t, err)
+			results <- payload
+		}()
+	}
+	<-started
+
+	// The waiting requests give up with their own context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := w.fetchFile(ctx, "gs://bucket-1/file.pdf")
+	require.ErrorIs(t, err, context.Canceled)
+
+	close(finish)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, []byte("payload"), <-results)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestWorkerProcessCoalesce(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+
+	var (
+		started = make(chan struct{})
+		finish  = make(chan struct{})
+		fetches int32
+	)
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getGCSReader: func(context.Context, string, string) (io.ReadCloser, error) {
+			if atomic.AddInt32(&fetches, 1) == 1 {
+				close(started)
+				<-finish
+			}
+			return io.NopCloser(bytes.NewReader(payload)), nil
+		},
+	}
+	require.NoError(t, w.Init())
+	waiting := make(chan string, 5)
+	w.fetches.waiting = func(key string) { waiting <- key }
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	process := func(ctx context.Context, width int) <-chan []byte {
+		result := make(chan []byte, 1)
+		go func() {
+			var output bytes.Buffer
+			err := w.Process(ctx, url, "gs://bucket-1/file.pdf", 1, width, 0, FormatPNG, 0, &output)
+			require.NoError(t, err)
+			result <- output.Bytes()
+		}()
+		return result
+	}
+
+	leader := process(context.Background(), 100)
+	<-started
+	var followers []<-chan []byte
+	for i := 0; i < 4; i++ {
+		followers = append(followers, process(context.Background(), 100))
+	}
+
+	// A different render of the same document shares the fetch, the requests bypassing the cache fetch it again.
+	other := process(context.Background(), 50)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, "gs://bucket-1/file.pdf|false", <-waiting)
+	}
+	bypass := process(WithBypassCache(context.Background()), 100)
+
+	close(finish)
+	expected := <-leader
+	require.NotEmpty(t, expected)
+	for _, follower := range followers {
+		require.Equal(t, expected, <-follower)
+	}
+	require.NotEqual(t, expected, <-other)
+	require.Equal(t, expected, <-bypass)
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	require.Empty(t, waiting)
+}
+
+func TestWorkerProcessVersion(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+	payloads := [][]byte{payload, append(append([]byte{}, payload...), '\n')}
+	var fetches int32
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getGCSReader: func(context.Context, string, string) (io.ReadCloser, error) {
+			index := atomic.AddInt32(&fetches, 1) - 1
+			return io.NopCloser(bytes.NewReader(payloads[index])), nil
+		},
+	}
+	require.NoError(t, w.Init())
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+
+	// The version follows the content of the document.
+	var output renderRecorder
+	require.NoError(t, w.Process(context.Background(), url, "gs://bucket-1/file.pdf", 1, 50, 0, FormatPNG, 0, &output))
+	require.NotEmpty(t, output.Bytes())
+	require.Equal(t, newDocument(payloads[0]).version, output.render.Version)
+
+	// The observer can skip the render once it knows the version.
+	output = renderRecorder{skip: true}
+	require.NoError(t, w.Process(context.Background(), url, "gs://bucket-1/file.pdf", 1, 50, 0, FormatPNG, 0, &output))
+	require.Empty(t, output.Bytes())
+	require.Equal(t, newDocument(payloads[1]).version, output.render.Version)
+	require.NotEqual(t, newDocument(payloads[0]).version, output.render.Version)
+
+	// The token is checked before the document is fetched.
+	output = renderRecorder{}
+	err = w.Process(context.Background(), "documents", "gs://bucket-1/file.pdf", 1, 50, 0, FormatPNG, 0, &output)
+	require.ErrorIs(t, err, ErrClient)
+	require.Equal(t, Render{}, output.render)
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestCallGroupCanceled(t *testing.T) {
+	t.Parallel()
+
+	var (
+		waiting = make(chan string, 1)
+		g       = callGroup{waiting: func(key string) { waiting <- key }}
+		started = make(chan struct{})
+		calls   int32
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := g.do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-ctx.Done()
+			return nil, fmt.Errorf("fail to render: %w", ctx.Err())
+		})
+		leader <- err
+	}()
+	<-started
+
+	follower := make(chan interface{}, 1)
+	go func() {
+		result, err := g.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return []byte("result"), nil
+		})
+		require.NoError(t, err)
+		follower <- result
+	}()
+	require.Equal(t, "key", <-waiting)
+
+	// The follower isn't affected by the cancellation of the leader, it does the work itself.
+	cancel()
+	require.ErrorIs(t, <-leader, context.Canceled)
+	require.Equal(t, []byte("result"), <-follower)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerSignURL(t *testing.T) {
+	t.Parallel()
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+	}
+	require.NoError(t, w.Init())
+
+	query := url.Values{"width": []string{"800"}, "page": []string{"2"}, "token": []string{"old"}}
+	signedURL := w.SignURL("/documents/bucket-1/file name.pdf", query)
+	require.True(t, strings.HasPrefix(signedURL, "/documents/bucket-1/file%20name.pdf?page=2&"))
+	require.NotContains(t, signedURL, "old")
+	require.True(t, w.validSignature(signedURL))
+}
+
+func TestWorkerPlaceholder(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+
+	var client mockS3
+	defer client.AssertExpectations(t)
+	client.
+		On("GetObjectWithContext", mock.Anything, mock.Anything).
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil)
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	token := urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "/documents/bucket-1/file.pdf")
+	url := fmt.Sprintf("/documents/bucket-1/file.pdf?token=%s", token)
+	placeholder, err := w.Placeholder(context.Background(), url, "bucket-1/file.pdf", 1)
+	require.NoError(t, err)
+
+	prefix := "data:image/png;base64,"
+	require.True(t, strings.HasPrefix(placeholder, prefix))
+	rawImage, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(placeholder, prefix))
+	require.NoError(t, err)
+	require.Less(t, len(rawImage), 2048)
+
+	cfg, err := png.DecodeConfig(bytes.NewReader(rawImage))
+	require.NoError(t, err)
+	require.Equal(t, placeholderWidth, cfg.Width)
+	require.NotZero(t, cfg.Height)
+}
+
+func TestWorkerDiff(t *testing.T) {
+	t.Parallel()
+
+	var client mockS3
+	defer client.AssertExpectations(t)
+	for version, fixture := range map[string]string{"v1": "testdata/diff-v1.pdf", "v2": "testdata/diff-v2.pdf"} {
+		payload, err := os.ReadFile(fixture)
+		require.NoError(t, err)
+		input := s3.GetObjectInput{
+			Bucket:    aws.String("bucket-1"),
+			Key:       aws.String("file.pdf"),
+			VersionId: aws.String(version),
+		}
+		output := s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}
+		client.On("GetObjectWithContext", mock.Anything, &input).Return(&output, nil)
+	}
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	var pages []PageDiff
+	err := w.Diff(context.Background(), url, "bucket-1/file.pdf", "v1", "v2", 100, func(page PageDiff) error {
+		// The images are only valid during the call.
+		page.Before = append([]byte(nil), page.Before...)
+		page.After = append([]byte(nil), page.After...)
+		pages = append(pages, page)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, pages, 1)
+	require.Equal(t, 2, pages[0].Page)
+	require.NotEqual(t, pages[0].Before, pages[0].After)
+	for _, rawImage := range [][]byte{pages[0].Before, pages[0].After} {
+		cfg, err := png.DecodeConfig(bytes.NewReader(rawImage))
+		require.NoError(t, err)
+		require.Equal(t, 100, cfg.Width)
+	}
+}
+
+func TestWorkerMaxPageCount(t *testing.T) {
+	t.Parallel()
+
+	payload := generatePDF(500)
+	var client mockS3
+	defer client.AssertExpectations(t)
+	for i := 0; i < 2; i++ {
+		client.
+			On("GetObjectWithContext", mock.Anything, mock.Anything).
+			Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil).
+			Once()
+	}
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		MaxPageCount:        100,
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	_, _, err := w.Metadata(context.Background(), url, "bucket-1/file.pdf")
+	require.ErrorIs(t, err, ErrClient)
+	require.Equal(t, "document has too many pages, can't be more than 100", err.Error())
+
+	err = w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 0, 0, FormatPNG, 0, io.Discard)
+	require.ErrorIs(t, err, ErrClient)
+}
+
+func TestWorkerRenderLimits(t *testing.T) {
+	t.Parallel()
+
+	payload := generatePDF(20)
+	var client mockS3
+	defer client.AssertExpectations(t)
+	client.
+		On("GetObjectWithContext", mock.Anything, mock.Anything).
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil).
+		Once()
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		MaxPageCount:        10,
+		MinWidth:            50,
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+		getGCSReader: func(context.Context, string, string) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(payload)), nil
+		},
+	}
+	require.NoError(t, w.Init())
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	discard := func(PageDiff) error { return nil }
+
+	// Every render entry point applies the limits of Process.
+	_, err := w.Validate(context.Background(), url, "gs://bucket-1/file.pdf")
+	require.EqualError(t, err, "document has too many pages, can't be more than 10")
+	err = w.ContactSheet(context.Background(), url, "gs://bucket-1/file.pdf", 0, 0, 0, io.Discard)
+	require.EqualError(t, err, "document has too many pages, can't be more than 10")
+	_, err = w.Placeholder(context.Background(), url, "gs://bucket-1/file.pdf", 1)
+	require.EqualError(t, err, "document has too many pages, can't be more than 10")
+	err = w.Cover(context.Background(), url, "gs://bucket-1/file.pdf", 1, FormatPNG, io.Discard)
+	require.EqualError(t, err, "document has too many pages, can't be more than 10")
+	err = w.Diff(context.Background(), url, "bucket-1/file.pdf", "v1", "v2", 0, discard)
+	require.ErrorIs(t, err, ErrClient)
+	require.Contains(t, err.Error(), "document has too many pages, can't be more than 10")
+
+	err = w.Diff(context.Background(), url, "bucket-1/file.pdf", "v1", "v2", 10, discard)
+	require.EqualError(t, err, "invalid width, can't be smaller than 50")
+	err = w.ContactSheet(context.Background(), url, "gs://bucket-1/file.pdf", 0, 10, 0, io.Discard)
+	require.EqualError(t, err, "invalid width, can't be smaller than 50")
+}
+
+func TestWorkerProcessDPI(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+	var client mockS3
+	defer client.AssertExpectations(t)
+	for i := 0; i < 2; i++ {
+		client.
+			On("GetObjectWithContext", mock.Anything, mock.Anything).
+			Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil).
+			Once()
+	}
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	scale, err := DPIScale(144)
+	require.NoError(t, err)
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	var auto, manual bytes.Buffer
+	require.NoError(t, w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 0, scale, FormatPNG, 0, &auto))
+
+	// The sample page is 612 points wide, at 144 dpi it's two pixels per point.
+	require.NoError(t, w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 1224, 0, FormatPNG, 0, &manual))
+	require.Equal(t, manual.Bytes(), auto.Bytes())
+
+	cfg, err := png.DecodeConfig(&auto)
+	require.NoError(t, err)
+	require.Equal(t, 1224, cfg.Width)
+}
+
+func TestWorkerDPIScale(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		dpi           int
+		expected      float32
+		expectedError string
+	}{
+		{message: "convert the resolution to a scale", dpi: 144, expected: 2},
+		{message: "accept the biggest resolution", dpi: 216, expected: 3},
+		{message: "use the lazypdf default scale when it's zero", dpi: 0, expected: 0},
+		{message: "reject a negative resolution", dpi: -72, expectedError: "invalid dpi"},
+		{message: "reject a resolution too big", dpi: 300, expectedError: "invalid dpi, can't be bigger than 216"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			scale, err := DPIScale(tt.dpi)
+			if tt.expectedError != "" {
+				require.ErrorIs(t, err, ErrClient)
+				require.Equal(t, tt.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, scale)
+		})
+	}
+}
+
+func TestWorkerProcessJPEG(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+
+	var client mockS3
+	defer client.AssertExpectations(t)
+	for i := 0; i < 2; i++ {
+		client.
+			On("GetObjectWithContext", mock.Anything, mock.Anything).
+			Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil).
+			Once()
+	}
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	err = w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 0, 0, FormatJPEG, 101, io.Discard)
+	require.EqualError(t, err, "invalid quality, must be between 1 and 100")
+
+	var low, high bytes.Buffer
+	require.NoError(t, w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 0, 0, FormatJPEG, 10, &low))
+	require.NoError(t, w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 0, 0, FormatJPEG, 95, &high))
+	for _, output := range [][]byte{low.Bytes(), high.Bytes()} {
+		_, decodedFormat, err := image.DecodeConfig(bytes.NewReader(output))
+		require.NoError(t, err)
+		require.Equal(t, FormatJPEG, decodedFormat)
+	}
+	require.Less(t, low.Len(), high.Len())
+}
+
+func TestWorkerMaxImageWidth(t *testing.T) {
+	t.Parallel()
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	tests := []struct {
+		message       string
+		maxImageWidth int
+		width         int
+		expectedError string
+	}{
+		{
+			message:       "accept a width up to the configured maximum",
+			maxImageWidth: 8192,
+			width:         8192,
+			expectedError: "fail to fetch the file: invalid path",
+		},
+		{
+			message:       "reject a width bigger than the configured maximum",
+			maxImageWidth: 8192,
+			width:         8193,
+			expectedError: "invalid width, can't be bigger than 8192",
+		},
+		{
+			message:       "reject a width bigger than the default maximum",
+			width:         4097,
+			expectedError: "invalid width, can't be bigger than 4096",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				MaxImageWidth:       tt.maxImageWidth,
+			}
+			require.NoError(t, w.Init())
+
+			err := w.Process(context.Background(), url, "documents", 1, tt.width, 0, FormatPNG, 0, io.Discard)
+			require.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+}
+
+func TestWorkerProcessMinWidth(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+
+	tests := []struct {
+		message       string
+		width         int
+		clamp         bool
+		expectedWidth int
+		expectedError string
+	}{
+		{
+			message:       "reject a width smaller than the minimum",
+			width:         10,
+			expectedError: "invalid width, can't be smaller than 50",
+		},
+		{
+			message:       "clamp a width smaller than the minimum",
+			width:         10,
+			clamp:         true,
+			expectedWidth: 50,
+		},
+		{
+			message:       "keep a width bigger than the minimum",
+			width:         60,
+			expectedWidth: 60,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var client mockS3
+			defer client.AssertExpectations(t)
+			if tt.expectedError == "" {
+				client.
+					On("GetObjectWithContext", mock.Anything, mock.Anything).
+					Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil)
+			}
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				MinWidth:            50,
+				ClampMinWidth:       tt.clamp,
+				getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+			}
+			require.NoError(t, w.Init())
+
+			var output renderRecorder
+			err := w.Process(context.Background(), url, "bucket-1/file.pdf", 1, tt.width, 0, FormatPNG, 0, &output)
+			if tt.expectedError != "" {
+				require.ErrorIs(t, err, ErrClient)
+				require.Equal(t, tt.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			cfg, err := png.DecodeConfig(&output)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedWidth, cfg.Width)
+			expectedRender := Render{
+				Page: 1, Width: tt.expectedWidth, Format: FormatPNG, Version: newDocument(payload).version,
+			}
+			require.Equal(t, expectedRender, output.render)
+		})
+	}
+}
+
+func TestWorkerTokenLeeway(t *testing.T) {
+	t.Parallel()
+
+	// The token is three buckets old, so it's one bucket past the ones accepted.
+	url := fmt.Sprintf(
+		"documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now().Add(-24*time.Hour), "documents"),
+	)
+
+	tests := []struct {
+		message       string
+		leeway        time.Duration
+		expectedError string
+	}{
+		{
+			message:       "reject an expired token without leeway",
+			expectedError: "invalid token",
+		},
+		{
+			message:       "reject an expired token beyond the leeway",
+			leeway:        time.Hour,
+			expectedError: "invalid token",
+		},
+		{
+			message:       "accept an expired token within the leeway",
+			leeway:        16 * time.Hour,
+			expectedError: "fail to fetch the file: invalid path",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				TokenLeeway:         tt.leeway,
+			}
+			require.NoError(t, w.Init())
+
+			err := w.Process(context.Background(), url, "documents", 1, 0, 0, FormatPNG, 0, io.Discard)
+			require.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+}
+
+func TestWorkerURLSigningBucketSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		bucketSize    time.Duration
+		tokenAge      time.Duration
+		expectedError string
+	}{
+		{
+			message:       "accept a token from the previous bucket",
+			bucketSize:    time.Hour,
+			tokenAge:      time.Hour,
+			expectedError: "fail to fetch the file: invalid path",
+		},
+		{
+			message:       "reject a token older than the previous bucket",
+			bucketSize:    time.Hour,
+			tokenAge:      3 * time.Hour,
+			expectedError: "invalid token",
+		},
+		{
+			message:       "accept the same token with the default bucket size",
+			tokenAge:      3 * time.Hour,
+			expectedError: "fail to fetch the file: invalid path",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:           http.DefaultClient,
+				URLSigningSecret:     "secret",
+				TraceExtractor:       traceExtractor,
+				StorageBucketRegion:  map[string]string{"bucket-1": "eu-central-1"},
+				URLSigningBucketSize: tt.bucketSize,
+			}
+			require.NoError(t, w.Init())
+
+			token := urlsign.GenerateToken("secret", w.URLSigningBucketSize, time.Now().Add(-tt.tokenAge), "documents")
+			url := fmt.Sprintf("documents?token=%s", token)
+			err := w.Process(context.Background(), url, "documents", 1, 0, 0, FormatPNG, 0, io.Discard)
+			require.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+}
+
+func TestWorkerURLSigningAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	baseTime := time.Date(2017, 9, 26, 13, 47, 0, 0, time.UTC)
+	tests := []struct {
+		message     string
+		algorithm   string
+		tokenTime   time.Time
+		legacyToken bool
+		expected    bool
+	}{
+		{
+			message:     "accept the tokens generated by urlsign in the legacy mode",
+			tokenTime:   baseTime,
+			legacyToken: true,
+			expected:    true,
+		},
+		{
+			message:     "reject the tokens generated by urlsign with SHA-256",
+			algorithm:   SignatureSHA256,
+			tokenTime:   baseTime,
+			legacyToken: true,
+		},
+		{
+			message:   "accept a SHA-256 token from the current bucket",
+			algorithm: SignatureSHA256,
+			tokenTime: baseTime,
+			expected:  true,
+		},
+		{
+			message:   "accept a SHA-256 token from the previous bucket",
+			algorithm: SignatureSHA256,
+			tokenTime: baseTime.Add(-8 * time.Hour),
+			expected:  true,
+		},
+		{
+			message:   "accept a SHA-256 token from the next bucket",
+			algorithm: SignatureSHA256,
+			tokenTime: baseTime.Add(8 * time.Hour),
+			expected:  true,
+		},
+		{
+			message:   "reject a SHA-256 token older than the previous bucket",
+			algorithm: SignatureSHA256,
+			tokenTime: baseTime.Add(-16 * time.Hour),
+		},
+		{
+			message:   "reject a SHA-256 token newer than the next bucket",
+			algorithm: SignatureSHA256,
+			tokenTime: baseTime.Add(16 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				URLSigningAlgorithm: tt.algorithm,
+			}
+			require.NoError(t, w.Init())
+
+			const canonical = "/documents/bucket-1/file.pdf?page=2&width=1024"
+			token := w.generateToken(tt.tokenTime, canonical)
+			if tt.legacyToken {
+				token = urlsign.GenerateToken("secret", 8*time.Hour, tt.tokenTime, canonical)
+			}
+			url := fmt.Sprintf("/documents/bucket-1/file.pdf?width=1024&page=2&token=%s", token)
+			require.Equal(t, tt.expected, w.validSignatureAt(baseTime, url))
+		})
+	}
+}
+
+func TestWorkerCover(t *testing.T) {
+	t.Parallel()
+
+	payload, err := os.ReadFile("testdata/sample.pdf")
+	require.NoError(t, err)
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+
+	tests := []struct {
+		message         string
+		width           int
+		height          int
+		expectedCorner  color.Color
+		requestedFormat string
+	}{
+		{
+			message:         "crop the page taller than the cover",
+			width:           400,
+			height:          210,
+			expectedCorner:  color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+			requestedFormat: FormatPNG,
+		},
+		{
+			message:         "pad the page shorter than the cover",
+			width:           200,
+			height:          400,
+			expectedCorner:  color.RGBA{R: 0xff, A: 0xff},
+			requestedFormat: FormatPNG,
+		},
+		{
+			message:         "render the cover as WebP",
+			width:           400,
+			height:          210,
+			requestedFormat: FormatWebP,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var client mockS3
+			defer client.AssertExpectations(t)
+			client.
+				On("GetObjectWithContext", mock.Anything, mock.Anything).
+				Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil)
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				CoverWidth:          tt.width,
+				CoverHeight:         tt.height,
+				CoverBackground:     "#ff0000",
+				getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+			}
+			require.NoError(t, w.Init())
+
+			var output bytes.Buffer
+			require.NoError(t, w.Cover(context.Background(), url, "bucket-1/file.pdf", 1, tt.requestedFormat, &output))
+			img, format, err := image.Decode(&output)
+			require.NoError(t, err)
+			require.Equal(t, tt.requestedFormat, format)
+			require.Equal(t, tt.width, img.Bounds().Dx())
+			require.Equal(t, tt.height, img.Bounds().Dy())
+			if tt.expectedCorner != nil {
+				require.Equal(t, tt.expectedCorner, color.RGBAModel.Convert(img.At(0, 0)))
+			}
+		})
+	}
+}
+
+func TestWorkerValidate(t *testing.T) {
+	t.Parallel()
+
+	// The page tree claims a page that doesn't exist, so the last page fails to render.
+	payload := bytes.Replace(generatePDF(2), []byte("/Count 2"), []byte("/Count 3"), 1)
+	var client mockS3
+	defer client.AssertExpectations(t)
+	client.
+		On("GetObjectWithContext", mock.Anything, mock.Anything).
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(payload))}, nil)
+
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		ValidateConcurrency: 2,
+		DocumentCacheSize:   1 << 20,
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	pages, err := w.Validate(context.Background(), url, "bucket-1/file.pdf")
+	require.NoError(t, err)
+	require.Equal(t, []PageValidation{
+		{Page: 1, Valid: true},
+		{Page: 2, Valid: true},
+		{Page: 3, Error: "failure at the C/MuPDF layer: cannot find page 3 in page tree"},
+	}, pages)
+	require.Empty(t, w.CachedDocuments())
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	t.Parallel()
+
+	var client mockS3
+	defer client.AssertExpectations(t)
+	client.
+		On("GetObjectWithContext", mock.Anything, mock.Anything).
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(generatePDF(1)))}, nil)
+
+	registry := prometheus.NewRegistry()
+	w := Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      traceExtractor,
+		StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+		MetricsRegisterer:   registry,
+		getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+	}
+	require.NoError(t, w.Init())
+
+	url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+	err := w.Process(context.Background(), url, "bucket-1/file.pdf", 1, 100, 0, FormatPNG, 0, io.Discard)
+	require.NoError(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	samples := make(map[string]uint64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			samples[family.GetName()+"/"+metric.GetLabel()[0].GetValue()] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	require.Equal(t, map[string]uint64{
+		"lazyraster_fetch_duration_seconds/s3":   1,
+		"lazyraster_render_duration_seconds/png": 1,
+	}, samples)
+}
+
+func TestWorkerContactSheet(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		pages          int
+		columns        int
+		maxPages       int
+		expectedWidth  int
+		expectedHeight int
+		expectedErr    bool
+	}{
+		{
+			message:        "tile the pages into a grid",
+			pages:          5,
+			columns:        2,
+			expectedWidth:  100,
+			expectedHeight: 3 * 65,
+		},
+		{
+			message:        "use a single row when there are less pages than columns",
+			pages:          2,
+			columns:        4,
+			expectedWidth:  100,
+			expectedHeight: 65,
+		},
+		{
+			message:     "refuse a document with more pages than the maximum",
+			pages:       3,
+			maxPages:    2,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var client mockS3
+			defer client.AssertExpectations(t)
+			client.
+				On("GetObjectWithContext", mock.Anything, mock.Anything).
+				Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(generatePDF(tt.pages)))}, nil)
+
+			w := Worker{
+				HTTPClient:          http.DefaultClient,
+				URLSigningSecret:    "secret",
+				TraceExtractor:      traceExtractor,
+				StorageBucketRegion: map[string]string{"bucket-1": "eu-central-1"},
+				getS3Client:         func(string) (s3iface.S3API, error) { return &client, nil },
+			}
+			require.NoError(t, w.Init())
+
+			url := fmt.Sprintf("documents?token=%s", urlsign.GenerateToken("secret", 8*time.Hour, time.Now(), "documents"))
+			var buf bytes.Buffer
+			err := w.ContactSheet(context.Background(), url, "bucket-1/file.pdf", tt.columns, 50, tt.maxPages, &buf)
+			if tt.expectedErr {
+				require.ErrorIs(t, err, ErrClient)
+				return
+			}
+			require.NoError(t, err)
+
+			cfg, err := png.DecodeConfig(&buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedWidth, cfg.Width)
+			require.Equal(t, tt.expectedHeight, cfg.Height)
+		})
+	}
+}
+
+// generatePDF creates a document with the given quantity of blank pages.
+func generatePDF(pages int) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+	}
+	kids := make([]string, 0, pages)
+	for i := 0; i < pages; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)+1))
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>")
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages)
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, 0, len(objects))
+	for i, object := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+type mockS3 struct {
+	s3iface.S3API
+	mock.Mock
+}
+
+func (m *mockS3) GetObjectWithContext(
+	ctx context.Context, input *s3.GetObjectInput, options ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+// mockAzureStorageError mimics the errors returned by the Azure SDK, its own implementation isn't exported.
+type mockAzureStorageError struct {
+	azblob.ResponseError
+	serviceCode azblob.ServiceCodeType
+}
+
+func (m mockAzureStorageError) Error() string {
+	return string(m.serviceCode)
+}
+
+func (m mockAzureStorageError) ServiceCode() azblob.ServiceCodeType {
+	return m.serviceCode
+}
+
+// renderRecorder keeps the render reported by the worker along with the output, the render is skipped when skip is
+// set.
+type renderRecorder struct {
+	bytes.Buffer
+	render Render
+	skip   bool
+}
+
+func (r *renderRecorder) Rendering(render Render) bool {
+	r.render = render
+	return !r.skip
+}
+
+func traceExtractor(context.Context, zerolog.Logger) (zerolog.Logger, error) {
+	return zerolog.Nop(), nil
+}
+
+func BenchmarkWorkerReadBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("lazyraster"), 2*1024*1024)
+	for _, size := range []int{4 * 1024, 32 * 1024, 256 * 1024, 1024 * 1024} {
+		size := size
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			w := Worker{ReadBufferSize: size}
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.readBody(bytes.NewReader(payload)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
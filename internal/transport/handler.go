@@ -1,14 +1,21 @@
 package transport
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
@@ -17,8 +24,17 @@ import (
 )
 
 type handlerDocumentService interface {
-	Process(context.Context, string, string, int, int, float32, io.Writer) error
+	Process(context.Context, string, string, int, int, float32, string, int, io.Writer) error
+	Cover(context.Context, string, string, int, string, io.Writer) error
 	Metadata(context.Context, string, string) (string, int, error)
+	Placeholder(context.Context, string, string, int) (string, error)
+	Diff(context.Context, string, string, string, string, int, func(service.PageDiff) error) error
+	Validate(context.Context, string, string) ([]service.PageValidation, error)
+	ContactSheet(context.Context, string, string, int, int, int, io.Writer) error
+	SignURL(string, url.Values) string
+	CachedDocuments() []service.CachedDocument
+	PurgeCache(string) int
+	Stats() service.WorkerStats
 }
 
 type handler struct {
@@ -26,6 +42,34 @@ type handler struct {
 	logger          zerolog.Logger
 	traceExtractor  traceExtractor
 	documentService handlerDocumentService
+	basePath        string
+
+	// When defaultToFirstPage is set a request without the page parameter renders the first page, and the metadata is
+	// only returned when 'metadata=true' is present.
+	defaultToFirstPage bool
+
+	// When zeroBasedPages is set the requests number the first page as 0 instead of 1. The service always uses 1.
+	zeroBasedPages bool
+
+	// bucketRenderDefaults are applied to the parameters the request omits.
+	bucketRenderDefaults map[string]RenderDefaults
+
+	// contentChecksum sets the header 'X-Content-SHA256' at the rendered pages.
+	contentChecksum bool
+
+	// thumbnailWidth is used by the thumbnails when the request doesn't set the width.
+	thumbnailWidth int
+
+	// The server isn't ready when the renderQueue has readinessThreshold or more requests waiting. A zero threshold
+	// means it's always ready.
+	renderQueue        *renderQueue
+	readinessThreshold int
+
+	// inFlight is the quantity of document requests being processed, it's reported by the health check.
+	inFlight *int64
+
+	// draining is set once the server starts to shut down, from then on it isn't ready.
+	draining *int32
 }
 
 func (h handler) notFound(w http.ResponseWriter, r *http.Request) {
@@ -36,8 +80,57 @@ func (h handler) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	h.writer.error(r.Context(), w, "Method not allowed", nil, http.StatusMethodNotAllowed)
 }
 
+// health is always healthy while the server is up, the remaining fields describe how loaded the server is to help the
+// autoscaling decisions.
 func (h handler) health(w http.ResponseWriter, r *http.Request) {
-	h.writer.response(r.Context(), w, map[string]interface{}{"status": "healthy"}, http.StatusOK)
+	stats := h.documentService.Stats()
+	result := map[string]interface{}{
+		"status":    "healthy",
+		"openFiles": stats.OpenFiles,
+		"s3Clients": stats.S3Clients,
+	}
+	if stats.CachedDocuments > 0 {
+		result["documentCache"] = map[string]interface{}{"documents": stats.CachedDocuments, "size": stats.CacheSize}
+	}
+	if h.inFlight != nil {
+		result["inFlight"] = atomic.LoadInt64(h.inFlight)
+	}
+	if h.renderQueue != nil {
+		active, waiting := h.renderQueue.stats()
+		result["renderQueue"] = map[string]interface{}{"active": active, "waiting": waiting}
+	}
+	h.writer.response(r.Context(), w, result, http.StatusOK)
+}
+
+// ready reports if the server can take more traffic. Unlike health it fails when the render queue is saturated or the
+// server is shutting down.
+func (h handler) ready(w http.ResponseWriter, r *http.Request) {
+	if h.draining != nil && atomic.LoadInt32(h.draining) == 1 {
+		h.writer.response(r.Context(), w, map[string]interface{}{"status": "draining"}, http.StatusServiceUnavailable)
+		return
+	}
+	if h.readinessThreshold > 0 && h.renderQueue != nil {
+		if _, waiting := h.renderQueue.stats(); waiting >= h.readinessThreshold {
+			status := map[string]interface{}{"status": "saturated"}
+			h.writer.response(r.Context(), w, status, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	h.writer.response(r.Context(), w, map[string]interface{}{"status": "ready"}, http.StatusOK)
+}
+
+// preflight answers the CORS preflight requests. The allowed origin header is set by the cors middleware, when it's
+// missing the browser blocks the request.
+func (h handler) preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, OPTIONS")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", "3600")
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h handler) document(w http.ResponseWriter, r *http.Request) {
@@ -48,11 +141,18 @@ func (h handler) document(w http.ResponseWriter, r *http.Request) {
 		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
 		return
 	}
+	logger = requestLogger(r.Context(), logger)
 
+	// The social mode renders a cover for link previews, by default from the first page.
+	social := r.URL.Query().Get("social") == "true"
+	rawPages := r.URL.Query().Get("pages")
 	rawPage := r.URL.Query().Get("page")
 	if rawPage == "" {
-		h.metadata(w, r)
-		return
+		if !social && rawPages == "" && (!h.defaultToFirstPage || r.URL.Query().Get("metadata") == "true") {
+			h.metadata(w, r)
+			return
+		}
+		rawPage = strconv.Itoa(h.requestPage(1))
 	}
 
 	page, err := strconv.Atoi(rawPage)
@@ -61,8 +161,10 @@ func (h handler) document(w http.ResponseWriter, r *http.Request) {
 		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
 		return
 	}
+	page = h.internalPage(page)
 
-	var width int
+	defaults := h.bucketRenderDefaults[h.documentBucket(r)]
+	width := defaults.Width
 	rawWidth := r.URL.Query().Get("width")
 	if rawWidth != "" {
 		width, err = strconv.Atoi(rawWidth)
@@ -84,29 +186,332 @@ func (h handler) document(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/documents/")
-	buf := bytes.NewBuffer([]byte{})
-	err = h.documentService.Process(r.Context(), r.URL.String(), path, page, width, float32(scale), buf)
-	if ctxErr := r.Context().Err(); ctxErr != nil {
-		logger.Err(ctxErr).Str("requestID", reqID).Msg("Context error")
-		if ctxErr == context.Canceled {
+	// The auto mode renders the page at its natural size with the requested resolution, any width is ignored. A zero
+	// dpi falls back to the lazypdf default scale.
+	if r.URL.Query().Get("auto") == "true" {
+		dpi, err := strconv.Atoi(r.URL.Query().Get("dpi"))
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Invalid 'dpi' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+		dpiScale, err := service.DPIScale(dpi)
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Invalid 'dpi' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
 			return
 		}
-		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusRequestTimeout)
+		width, scale = 0, float64(dpiScale)
+	}
+
+	// The quality is only used by the lossy formats that support it, the service validates the range.
+	quality := defaults.Quality
+	rawQuality := r.URL.Query().Get("quality")
+	if rawQuality != "" {
+		quality, err = strconv.Atoi(rawQuality)
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Invalid 'quality' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// An explicit format takes priority over the negotiated one and the bucket default.
+	format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+	if format != "" {
+		if _, ok := formatContentType(format); !ok {
+			logger.Error().Str("requestID", reqID).Msg("Invalid 'format' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+	} else {
+		preferFormats := r.URL.Query().Get("preferFormats")
+		if preferFormats == "" {
+			preferFormats = defaults.Format
+		}
+		var ok bool
+		format, ok = negotiateFormat(preferFormats)
+		if !ok {
+			logger.Error().Str("requestID", reqID).Msg("None of the 'preferFormats' is supported")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if rawPages != "" {
+		h.archive(w, r, logger, rawPages, width, float32(scale), format, quality)
+		return
+	}
+
+	// The page is streamed to the client, unless the checksum is required because it's a header sent before the body.
+	// The service reports the parameters it renders with before writing the page.
+	var (
+		buf         *bytes.Buffer
+		render      service.Render
+		etag        string
+		notModified bool
+	)
+	output := &pageWriter{w: w, header: func(header http.Header) {
+		contentType, _ := formatContentType(format)
+		header.Set("Content-Type", contentType)
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", pageCacheControl)
+		header.Set("X-Chosen-Format", format)
+		header.Set("X-Render-Params", h.renderParams(render))
+	}}
+	renderOutput := renderObserver{Writer: output, rendering: func(rendered service.Render) bool {
+		// The renders are deterministic, so the client copy is still valid when it was rendered the same way from the
+		// same document version. The cache bypass always renders the page again.
+		render = rendered
+		etag = renderETag(h.documentPath(r), render, social)
+		notModified = etagMatch(r.Header.Get("If-None-Match"), etag) && !service.BypassingCache(r.Context())
+		return !notModified
+	}}
+	if h.contentChecksum {
+		buf = acquireBuffer()
+		defer releaseBuffer(buf)
+		renderOutput.Writer = buf
+	}
+
+	renderStart := time.Now()
+	if social {
+		err = h.documentService.Cover(r.Context(), h.signedURL(r), h.documentPath(r), page, format, renderOutput)
+	} else {
+		err = h.documentService.Process(
+			r.Context(), h.signedURL(r), h.documentPath(r), page, width, float32(scale), format, quality, renderOutput,
+		)
+	}
+	if output.started && (err != nil || r.Context().Err() != nil) {
+		logger.Err(err).Str("requestID", reqID).Msg("Fail to render, aborting the response")
+		panic(http.ErrAbortHandler)
+	}
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
+		return
+	}
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Error")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+		return
+	}
+	if notModified {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", pageCacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if buf != nil {
+		checksum := sha256.Sum256(buf.Bytes())
+		w.Header().Set("X-Content-SHA256", hex.EncodeToString(checksum[:]))
+		w.Header().Set("content-length", strconv.Itoa(buf.Len()))
+		if _, err := output.Write(buf.Bytes()); err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Fail to write the response back to the client")
+		}
+	}
+	output.start()
+
+	logger.Debug().
+		Str("requestID", reqID).
+		Int("page", page).
+		Int("width", width).
+		Float64("scale", scale).
+		Str("format", format).
+		Bool("social", social).
+		Dur("renderDuration", time.Since(renderStart)).
+		Int("size", output.written).
+		Msg("Document rendered")
+}
+
+// renderObserver is the output given to the service, it learns how the page is rendered before it's written.
+type renderObserver struct {
+	io.Writer
+	rendering func(service.Render) bool
+}
+
+func (o renderObserver) Rendering(render service.Render) bool {
+	return o.rendering(render)
+}
+
+// pageWriter streams the rendered page to the client. The status and the headers are sent with the first write, so
+// the handler can still answer with an error while nothing was written.
+type pageWriter struct {
+	w       http.ResponseWriter
+	header  func(http.Header)
+	written int
+	started bool
+}
+
+func (p *pageWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	p.start()
+	n, err := p.w.Write(b)
+	p.written += n
+	return n, err
+}
+
+// start sends the status and the headers, if they weren't sent yet.
+func (p *pageWriter) start() {
+	if p.started {
+		return
+	}
+	p.started = true
+	p.header(p.w.Header())
+	p.w.WriteHeader(http.StatusOK)
+}
+
+// archive renders a range of pages into a ZIP with an entry per page. The archive is streamed, each page is written as
+// soon as it's rendered, so only one page is kept in memory. Once the first entry is written the status can't be
+// changed anymore, so a failure after that aborts the connection and the client gets a truncated archive.
+func (h handler) archive(
+	w http.ResponseWriter, r *http.Request, logger zerolog.Logger, rawPages string, width int, scale float32,
+	format string, quality int,
+) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	pages, err := parsePageRange(rawPages, h.requestPage(1), maxArchivePages)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Invalid 'pages' parameter")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+		return
+	}
+
+	buf := acquireBuffer()
+	defer releaseBuffer(buf)
+	var archive *zip.Writer
+	for _, page := range pages {
+		buf.Reset()
+		err := h.documentService.Process(
+			r.Context(), h.signedURL(r), h.documentPath(r), h.internalPage(page), width, scale, format, quality, buf,
+		)
+		if archive == nil {
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				h.contextError(w, r, logger, ctxErr)
+				return
+			}
+			if err != nil {
+				logger.Err(err).Str("requestID", reqID).Msg("Error")
+				h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("X-Chosen-Format", format)
+			w.WriteHeader(http.StatusOK)
+			archive = zip.NewWriter(w)
+		} else if err != nil {
+			logger.Err(err).Str("requestID", reqID).Int("page", page).Msg("Fail to render, aborting the archive")
+			panic(http.ErrAbortHandler)
+		}
+
+		if err := writeArchiveEntry(archive, fmt.Sprintf("page-%d.%s", page, format), buf.Bytes()); err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Fail to write the archive back to the client")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Fail to write the archive back to the client")
+	}
+}
+
+// writeArchiveEntry adds the file to the archive without compressing it, the pages are already compressed images and
+// compressing them again only wastes CPU.
+func writeArchiveEntry(archive *zip.Writer, name string, payload []byte) error {
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(payload)
+	return err
+}
+
+// placeholder returns a tiny blurred version of the page and the URL to fetch the full page. The token is the same one
+// used to fetch the page from the '/documents/' route.
+func (h handler) placeholder(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
 		return
 	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, service.ErrClient) {
-			status = http.StatusBadRequest
-		} else if errors.Is(err, service.ErrNotFound) {
-			status = http.StatusNotFound
+		logger.Err(err).Str("requestID", reqID).Msg("Invalid 'page' parameter")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+		return
+	}
+	page = h.internalPage(page)
+
+	path := strings.TrimPrefix(r.URL.Path, h.basePath+"/placeholder/")
+	documentURL := h.documentURL(r, path)
+
+	placeholder, err := h.documentService.Placeholder(r.Context(), documentURL, path, page)
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
+		return
+	}
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Error")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+		return
+	}
+	result := map[string]interface{}{
+		"Placeholder": placeholder,
+		"URL":         h.basePath + documentURL,
+	}
+	h.writer.response(r.Context(), w, result, http.StatusOK)
+}
+
+// thumbnail renders the first page of the document as a small PNG. The token is the same one used to fetch the page
+// from the '/documents/' route. The width can be overridden but it's capped at maxThumbnailWidth.
+func (h handler) thumbnail(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	width := h.thumbnailWidth
+	rawWidth := r.URL.Query().Get("width")
+	if rawWidth != "" {
+		width, err = strconv.Atoi(rawWidth)
+		if err != nil || width <= 0 {
+			logger.Err(err).Str("requestID", reqID).Msg("Invalid 'width' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+		if width > maxThumbnailWidth {
+			width = maxThumbnailWidth
 		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, h.basePath+"/thumbnail/")
+	documentURL := h.documentURL(r, path)
+
+	buf := acquireBuffer()
+	defer releaseBuffer(buf)
+	var render service.Render
+	output := renderObserver{Writer: buf, rendering: func(rendered service.Render) bool {
+		render = rendered
+		return true
+	}}
+	err = h.documentService.Process(r.Context(), documentURL, path, 1, width, 0, service.FormatPNG, 0, output)
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
+		return
+	}
+	if err != nil {
 		logger.Err(err).Str("requestID", reqID).Msg("Error")
-		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, status)
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
 		return
 	}
 
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Render-Params", h.renderParams(render))
 	w.Header().Set("content-length", strconv.Itoa(len(buf.Bytes())))
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(buf.Bytes()); err != nil {
@@ -114,7 +519,11 @@ func (h handler) document(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h handler) metadata(w http.ResponseWriter, r *http.Request) {
+// diff streams a ZIP with the pages that changed between the versions 'from' and 'to' of the document. Each changed
+// page has the entries 'page-N-before.png', when it exists at the 'from' version, and 'page-N-after.png', the
+// archive ends with 'pages.json' listing the changed pages. Like the pages archive, a failure after the first entry
+// aborts the connection.
+func (h handler) diff(w http.ResponseWriter, r *http.Request) {
 	reqID := chiMiddleware.GetReqID(r.Context())
 	logger, err := h.traceExtractor(r.Context(), h.logger)
 	if err != nil {
@@ -123,25 +532,216 @@ func (h handler) metadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/documents/")
-	fileName, pageCount, err := h.documentService.Metadata(r.Context(), r.URL.String(), path)
-	if ctxErr := r.Context().Err(); ctxErr != nil {
-		logger.Err(ctxErr).Str("requestID", reqID).Msg("Context error")
-		if ctxErr == context.Canceled {
+	var width int
+	rawWidth := r.URL.Query().Get("width")
+	if rawWidth != "" {
+		width, err = strconv.Atoi(rawWidth)
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Invalid 'width' parameter")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		archive *zip.Writer
+		pages   = []int{}
+	)
+	startArchive := func() {
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+		archive = zip.NewWriter(w)
+	}
+	path := strings.TrimPrefix(r.URL.Path, h.basePath+"/diff/")
+	err = h.documentService.Diff(
+		r.Context(), h.documentURL(r, path), path, r.URL.Query().Get("from"), r.URL.Query().Get("to"), width,
+		func(diff service.PageDiff) error {
+			if archive == nil {
+				startArchive()
+			}
+			page := h.requestPage(diff.Page)
+			pages = append(pages, page)
+			if len(diff.Before) > 0 {
+				if err := writeArchiveEntry(archive, fmt.Sprintf("page-%d-before.png", page), diff.Before); err != nil {
+					return err
+				}
+			}
+			return writeArchiveEntry(archive, fmt.Sprintf("page-%d-after.png", page), diff.After)
+		},
+	)
+	if archive == nil {
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			h.contextError(w, r, logger, ctxErr)
 			return
 		}
-		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusRequestTimeout)
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msg("Error")
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+			return
+		}
+		startArchive()
+	} else if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Fail to diff, aborting the archive")
+		panic(http.ErrAbortHandler)
+	}
+
+	index, err := json.Marshal(map[string]interface{}{"Pages": pages})
+	if err == nil {
+		err = writeArchiveEntry(archive, "pages.json", index)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Fail to write the archive back to the client")
+	}
+}
+
+// validate renders every page of the document and reports the ones that fail.
+func (h handler) validate(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, h.basePath+"/validate/")
+	pages, err := h.documentService.Validate(r.Context(), h.documentURL(r, path), path)
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
 		return
 	}
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, service.ErrClient) {
-			status = http.StatusBadRequest
-		} else if errors.Is(err, service.ErrNotFound) {
-			status = http.StatusNotFound
+		logger.Err(err).Str("requestID", reqID).Msg("Error")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+		return
+	}
+	valid := true
+	for i := range pages {
+		valid = valid && pages[i].Valid
+		pages[i].Page = h.requestPage(pages[i].Page)
+	}
+	h.writer.response(r.Context(), w, map[string]interface{}{"Valid": valid, "Pages": pages}, http.StatusOK)
+}
+
+// contactSheet renders every page of the document as a thumbnail and tiles them into a single PNG.
+func (h handler) contactSheet(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	var params [3]int
+	for i, name := range []string{"columns", "thumbWidth", "maxPages"} {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			continue
 		}
+		params[i], err = strconv.Atoi(raw)
+		if err != nil {
+			logger.Err(err).Str("requestID", reqID).Msgf("Invalid '%s' parameter", name)
+			h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, h.basePath+"/contactsheet/")
+	buf := acquireBuffer()
+	defer releaseBuffer(buf)
+	err = h.documentService.ContactSheet(
+		r.Context(), h.documentURL(r, path), path, params[0], params[1], params[2], buf,
+	)
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
+		return
+	}
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Error")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("content-length", strconv.Itoa(len(buf.Bytes())))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Fail to write the response back to the client")
+	}
+}
+
+// sign returns the URL signed with the server secret. The target is the 'path' parameter, all the other parameters are
+// signed together with it.
+func (h handler) sign(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+	if !strings.HasPrefix(path, "/") {
+		logger.Error().Str("requestID", reqID).Msg("Invalid 'path' parameter")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusBadRequest)
+		return
+	}
+	query.Del("path")
+
+	result := map[string]interface{}{"url": h.basePath + h.documentService.SignURL(path, query)}
+	h.writer.response(r.Context(), w, result, http.StatusOK)
+}
+
+// listCache returns the documents at the document cache, the most recently used first.
+func (h handler) listCache(w http.ResponseWriter, r *http.Request) {
+	documents := h.documentService.CachedDocuments()
+	result := make([]map[string]interface{}, 0, len(documents))
+	for _, document := range documents {
+		result = append(result, map[string]interface{}{"path": document.Path, "size": document.Size})
+	}
+	h.writer.response(r.Context(), w, map[string]interface{}{"documents": result}, http.StatusOK)
+}
+
+// purgeCache removes the document at the 'path' parameter from the document cache, without it the whole cache is
+// purged.
+func (h handler) purgeCache(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	purged := h.documentService.PurgeCache(path)
+	logger.Info().Str("requestID", reqID).Str("path", path).Int("purged", purged).Msg("Document cache purged")
+	h.writer.response(r.Context(), w, map[string]interface{}{"purged": purged}, http.StatusOK)
+}
+
+func (h handler) metadata(w http.ResponseWriter, r *http.Request) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger, err := h.traceExtractor(r.Context(), h.logger)
+	if err != nil {
+		logger.Err(err).Str("requestID", reqID).Msg("Could not extract tracing id")
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, http.StatusInternalServerError)
+		return
+	}
+
+	fileName, pageCount, err := h.documentService.Metadata(r.Context(), h.signedURL(r), h.documentPath(r))
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		h.contextError(w, r, logger, ctxErr)
+		return
+	}
+	if err != nil {
 		logger.Err(err).Str("requestID", reqID).Msg("Error")
-		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, status)
+		h.writer.error(r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), nil, errorStatus(err))
 		return
 	}
 	result := map[string]interface{}{
@@ -150,3 +750,162 @@ func (h handler) metadata(w http.ResponseWriter, r *http.Request) {
 	}
 	h.writer.response(r.Context(), w, result, http.StatusOK)
 }
+
+func (h handler) documentPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, h.basePath+"/documents/")
+}
+
+// documentBucket returns the bucket from the document path, for Dropbox documents it's 'dropbox'.
+func (h handler) documentBucket(r *http.Request) string {
+	return strings.SplitN(h.documentPath(r), "/", 2)[0]
+}
+
+// signedURL returns the URL used to validate the request signature. The clients sign the URL without the base path,
+// so it needs to be removed.
+func (h handler) signedURL(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.String(), h.basePath)
+}
+
+// documentURL returns the URL of the document at the '/documents/' route with the query of the request. The routes
+// that render the document elsewhere check the token against it, so every route is signed the same way.
+func (h handler) documentURL(r *http.Request, path string) string {
+	if r.URL.RawQuery == "" {
+		return "/documents/" + path
+	}
+	return "/documents/" + path + "?" + r.URL.RawQuery
+}
+
+// contextError handles the requests that finished because the context is done. When the client went away there is
+// nobody to answer to, so no body is written, otherwise the request timed out.
+func (h handler) contextError(w http.ResponseWriter, r *http.Request, logger zerolog.Logger, ctxErr error) {
+	reqID := chiMiddleware.GetReqID(r.Context())
+	logger.Err(ctxErr).Str("requestID", reqID).Msg("Context error")
+	if ctxErr == context.Canceled {
+		return
+	}
+	h.writer.errorWithReason(
+		r.Context(), w, fmt.Sprintf("Request ID '%s'", reqID), "request_timeout", nil, http.StatusGatewayTimeout,
+	)
+}
+
+// parsePageRange parses a comma separated list of pages and ranges of pages, like '1,3-5'. An error is returned when
+// a page is before the first one or the list has more than max pages.
+func parsePageRange(raw string, first, max int) ([]int, error) {
+	var pages []int
+	for _, item := range strings.Split(raw, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid page '%s'", item)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid page '%s'", item)
+			}
+		}
+		if start < first || end < start {
+			return nil, fmt.Errorf("invalid range '%s'", item)
+		}
+		if end-start+1 > max-len(pages) {
+			return nil, fmt.Errorf("too many pages, can't be more than %d", max)
+		}
+		for page := start; page <= end; page++ {
+			pages = append(pages, page)
+		}
+	}
+	return pages, nil
+}
+
+// internalPage converts the page from the request numbering to the service one, where the first page is 1.
+func (h handler) internalPage(page int) int {
+	if h.zeroBasedPages {
+		return page + 1
+	}
+	return page
+}
+
+// requestPage converts the page from the service numbering to the request one.
+func (h handler) requestPage(page int) int {
+	if h.zeroBasedPages {
+		return page - 1
+	}
+	return page
+}
+
+// renderETag is a strong entity tag derived from everything that changes the rendered page, the document version
+// included. It uses the render reported by the service, so the requests that end up with the same image share the tag.
+func renderETag(path string, render service.Render, social bool) string {
+	key := fmt.Sprintf(
+		"%s|%s|%d|%d|%g|%s|%d|%t",
+		path, render.Version, render.Page, render.Width, render.Scale, render.Format, render.Quality, social,
+	)
+	hash := sha256.Sum256([]byte(key))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatch checks the 'If-None-Match' header against the entity tag, with the weak comparison used by conditional
+// GETs. It's only called once the token is checked and the document fetched, so '*' matches an existing document.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderParams describes the render the service did, after the defaults and the limits were applied, it's returned
+// to the clients to help debugging unexpected results. A zero width means the width follows the scale, and a zero
+// scale is the lazypdf default one.
+func (h handler) renderParams(render service.Render) string {
+	params := url.Values{}
+	params.Set("page", strconv.Itoa(h.requestPage(render.Page)))
+	params.Set("width", strconv.Itoa(render.Width))
+	params.Set("scale", strconv.FormatFloat(float64(render.Scale), 'f', -1, 32))
+	params.Set("format", render.Format)
+	params.Set("quality", strconv.Itoa(render.Quality))
+	return params.Encode()
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrClient):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// negotiateFormat picks the first format the service supports from the comma separated list of formats the client
+// prefers. When the client has no preference PNG is used.
+func negotiateFormat(preferFormats string) (string, bool) {
+	if preferFormats == "" {
+		return service.FormatPNG, true
+	}
+	for _, format := range strings.Split(preferFormats, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if _, ok := formatContentType(format); ok {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+func formatContentType(format string) (string, bool) {
+	switch format {
+	case service.FormatPNG:
+		return "image/png", true
+	case service.FormatWebP:
+		return "image/webp", true
+	case service.FormatJPEG:
+		return "image/jpeg", true
+	default:
+		return "", false
+	}
+}
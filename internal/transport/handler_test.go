@@ -0,0 +1,1080 @@
+package transport
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nitro/lazyraster/v2/internal/service"
+)
+
+func TestHandlerDocumentContextError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		cancel         bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			message:        "return a timeout error with a reason",
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedBody:   `{"error":{"title":"Request ID 'id'","reason":"request_timeout"}}`,
+		},
+		{
+			message:        "not write a body when the client cancels the request",
+			cancel:         true,
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.WithValue(context.Background(), chiMiddleware.RequestIDKey, "id")
+			ctx, ctxCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer ctxCancel()
+			if tt.cancel {
+				ctxCancel()
+			}
+
+			var documentService mockDocumentService
+			documentService.
+				On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+					mock.Anything,
+				).
+				Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+				Return(context.DeadlineExceeded)
+			h := newTestHandler(&documentService)
+
+			req := httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.document(w, req)
+			require.Equal(t, tt.expectedStatus, w.Code)
+			require.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandlerDocumentDefaultPage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message            string
+		target             string
+		defaultToFirstPage bool
+		expectMetadata     bool
+	}{
+		{
+			message:        "return the metadata when the page is omitted",
+			target:         "/documents/bucket/file.pdf",
+			expectMetadata: true,
+		},
+		{
+			message:            "render the first page when the page is omitted",
+			target:             "/documents/bucket/file.pdf",
+			defaultToFirstPage: true,
+		},
+		{
+			message:            "return the metadata when explicitly requested",
+			target:             "/documents/bucket/file.pdf?metadata=true",
+			defaultToFirstPage: true,
+			expectMetadata:     true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			if tt.expectMetadata {
+				documentService.
+					On("Metadata", mock.Anything, tt.target, "bucket/file.pdf").
+					Return("file.pdf", 3, nil)
+			} else {
+				documentService.
+					On(
+						"Process", mock.Anything, tt.target, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+						mock.Anything,
+					).
+					Return(nil)
+			}
+			h := newTestHandler(&documentService)
+			h.defaultToFirstPage = tt.defaultToFirstPage
+
+			w := httptest.NewRecorder()
+			h.document(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestHandlerDocumentFormatNegotiation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message         string
+		target          string
+		expectedStatus  int
+		expectedFormat  string
+		expectedQuality int
+	}{
+		{
+			message:        "default to PNG",
+			target:         "/documents/bucket/file.pdf?page=1",
+			expectedStatus: http.StatusOK,
+			expectedFormat: "png",
+		},
+		{
+			message:        "pick the first supported format",
+			target:         "/documents/bucket/file.pdf?page=1&preferFormats=avif,webp,png",
+			expectedStatus: http.StatusOK,
+			expectedFormat: "webp",
+		},
+		{
+			message:        "fall back to PNG when the preferred formats aren't supported",
+			target:         "/documents/bucket/file.pdf?page=1&preferFormats=avif,png",
+			expectedStatus: http.StatusOK,
+			expectedFormat: "png",
+		},
+		{
+			message:        "fail when none of the preferred formats is supported",
+			target:         "/documents/bucket/file.pdf?page=1&preferFormats=avif,heic",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:         "pick JPEG with the requested quality",
+			target:          "/documents/bucket/file.pdf?page=1&preferFormats=jpeg&quality=80",
+			expectedStatus:  http.StatusOK,
+			expectedFormat:  "jpeg",
+			expectedQuality: 80,
+		},
+		{
+			message:        "fail with an invalid quality",
+			target:         "/documents/bucket/file.pdf?page=1&preferFormats=jpeg&quality=high",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:        "use the requested format",
+			target:         "/documents/bucket/file.pdf?page=1&format=webp",
+			expectedStatus: http.StatusOK,
+			expectedFormat: "webp",
+		},
+		{
+			message:        "prefer the requested format over the preferred formats",
+			target:         "/documents/bucket/file.pdf?page=1&format=WebP&preferFormats=png",
+			expectedStatus: http.StatusOK,
+			expectedFormat: "webp",
+		},
+		{
+			message:         "use the requested JPEG format with the requested quality",
+			target:          "/documents/bucket/file.pdf?page=1&format=jpeg&quality=80",
+			expectedStatus:  http.StatusOK,
+			expectedFormat:  "jpeg",
+			expectedQuality: 80,
+		},
+		{
+			message:        "fail when the requested format isn't supported",
+			target:         "/documents/bucket/file.pdf?page=1&format=avif&preferFormats=png",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			if tt.expectedFormat != "" {
+				documentService.
+					On(
+						"Process", mock.Anything, tt.target, "bucket/file.pdf", 1, 0, float32(0), tt.expectedFormat,
+						tt.expectedQuality, mock.Anything,
+					).
+					Return(nil)
+			}
+			h := newTestHandler(&documentService)
+
+			w := httptest.NewRecorder()
+			h.document(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedFormat != "" {
+				require.Equal(t, tt.expectedFormat, w.Header().Get("X-Chosen-Format"))
+				require.Equal(t, "image/"+tt.expectedFormat, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandlerDocumentRenderParams(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message            string
+		target             string
+		defaultToFirstPage bool
+		page               int
+		width              int
+		scale              float32
+		renderedWidth      int
+		expectedParams     string
+	}{
+		{
+			message:            "report the default page and format",
+			target:             "/documents/bucket/file.pdf",
+			defaultToFirstPage: true,
+			page:               1,
+			expectedParams:     "format=png&page=1&quality=0&scale=0&width=0",
+		},
+		{
+			message:        "report the requested values",
+			target:         "/documents/bucket/file.pdf?page=3&width=800&scale=1.5&preferFormats=avif,PNG",
+			page:           3,
+			width:          800,
+			scale:          1.5,
+			renderedWidth:  800,
+			expectedParams: "format=png&page=3&quality=0&scale=1.5&width=800",
+		},
+		{
+			message:        "report the scale derived from the dpi",
+			target:         "/documents/bucket/file.pdf?page=1&width=800&auto=true&dpi=144",
+			page:           1,
+			scale:          2,
+			expectedParams: "format=png&page=1&quality=0&scale=2&width=0",
+		},
+		{
+			message:        "report the width clamped by the service",
+			target:         "/documents/bucket/file.pdf?page=1&width=50",
+			page:           1,
+			width:          50,
+			renderedWidth:  100,
+			expectedParams: "format=png&page=1&quality=0&scale=0&width=100",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			documentService.
+				On(
+					"Process", mock.Anything, tt.target, "bucket/file.pdf", tt.page, tt.width, tt.scale, "png", 0,
+					mock.Anything,
+				).
+				Run(reportRender(
+					service.Render{Page: tt.page, Width: tt.renderedWidth, Scale: tt.scale, Format: "png"},
+				)).
+				Return(nil)
+			h := newTestHandler(&documentService)
+			h.defaultToFirstPage = tt.defaultToFirstPage
+
+			w := httptest.NewRecorder()
+			h.document(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expectedParams, w.Header().Get("X-Render-Params"))
+		})
+	}
+}
+
+func TestHandlerDocumentContentChecksum(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message         string
+		contentChecksum bool
+	}{
+		{
+			message:         "set the checksum of the body",
+			contentChecksum: true,
+		},
+		{
+			message: "not set the checksum when disabled",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			documentService.
+				On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+					mock.Anything,
+				).
+				Run(func(args mock.Arguments) { _, _ = args.Get(8).(io.Writer).Write([]byte("rendered page")) }).
+				Return(nil)
+			h := newTestHandler(&documentService)
+			h.contentChecksum = tt.contentChecksum
+
+			w := httptest.NewRecorder()
+			h.document(w, httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			if !tt.contentChecksum {
+				require.Empty(t, w.Header().Get("X-Content-SHA256"))
+				return
+			}
+			checksum := sha256.Sum256(w.Body.Bytes())
+			require.Equal(t, hex.EncodeToString(checksum[:]), w.Header().Get("X-Content-SHA256"))
+		})
+	}
+}
+
+func TestHandlerDocumentETag(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	for _, width := range []int{0, 100} {
+		documentService.
+			On(
+				"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, width, float32(0), "png", 0,
+				mock.Anything,
+			).
+			Run(reportRender(service.Render{Page: 1, Width: width, Format: "png", Version: "v1"})).
+			Return(nil)
+	}
+	// The widths above the maximum are clamped by the service, they're rendered like the maximum one.
+	documentService.
+		On(
+			"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 5000, float32(0), "png", 0,
+			mock.Anything,
+		).
+		Run(reportRender(service.Render{Page: 1, Width: 100, Format: "png", Version: "v1"})).
+		Return(nil)
+	h := newTestHandler(&documentService)
+
+	request := func(target, ifNoneMatch string, bypass bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if bypass {
+			req = req.WithContext(service.WithBypassCache(req.Context()))
+		}
+		w := httptest.NewRecorder()
+		h.document(w, req)
+		return w
+	}
+
+	w := request("/documents/bucket/file.pdf?page=1", "", false)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "rendered page", w.Body.String())
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// The matching tag skips the render, the weak and listed forms included.
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = request("/documents/bucket/file.pdf?page=1", ifNoneMatch, false)
+		require.Equal(t, http.StatusNotModified, w.Code, ifNoneMatch)
+		require.Equal(t, etag, w.Header().Get("ETag"))
+		require.Empty(t, w.Body.String())
+	}
+
+	// Other parameters or the cache bypass render the page again.
+	w = request("/documents/bucket/file.pdf?page=1&width=100", etag, false)
+	require.Equal(t, http.StatusOK, w.Code)
+	clampedETag := w.Header().Get("ETag")
+	require.NotEqual(t, etag, clampedETag)
+	w = request("/documents/bucket/file.pdf?page=1", etag, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, etag, w.Header().Get("ETag"))
+
+	// The requests rendered the same way share the tag.
+	w = request("/documents/bucket/file.pdf?page=1&width=5000", clampedETag, false)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, clampedETag, w.Header().Get("ETag"))
+}
+
+func TestHandlerDocumentStreaming(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		written        string
+		err            error
+		expectedStatus int
+		expectedAbort  bool
+	}{
+		{
+			message:        "stream the rendered page",
+			written:        "rendered page",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			message:        "answer with an error when the render fails before writing",
+			err:            service.ErrClient,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:       "abort the response when the render fails after writing",
+			written:       "rendered",
+			err:           errors.New("fail to write"),
+			expectedAbort: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			documentService.
+				On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+					mock.Anything,
+				).
+				Run(func(args mock.Arguments) { _, _ = args.Get(8).(io.Writer).Write([]byte(tt.written)) }).
+				Return(tt.err)
+			h := newTestHandler(&documentService)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil)
+			if tt.expectedAbort {
+				require.PanicsWithValue(t, http.ErrAbortHandler, func() { h.document(w, req) })
+				return
+			}
+			h.document(w, req)
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				require.Equal(t, "image/png", w.Header().Get("Content-Type"))
+				require.Equal(t, tt.written, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerDocumentBucketRenderDefaults(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message         string
+		target          string
+		path            string
+		expectedWidth   int
+		expectedFormat  string
+		expectedQuality int
+	}{
+		{
+			message:        "apply the bucket defaults when the parameters are omitted",
+			target:         "/documents/bucket-1/file.pdf?page=1",
+			path:           "bucket-1/file.pdf",
+			expectedWidth:  800,
+			expectedFormat: "png",
+		},
+		{
+			message:        "prefer the parameters from the request",
+			target:         "/documents/bucket-1/file.pdf?page=1&width=300",
+			path:           "bucket-1/file.pdf",
+			expectedWidth:  300,
+			expectedFormat: "png",
+		},
+		{
+			message:        "prefer the format from the request",
+			target:         "/documents/bucket-1/file.pdf?page=1&format=webp",
+			path:           "bucket-1/file.pdf",
+			expectedWidth:  800,
+			expectedFormat: "webp",
+		},
+		{
+			message:        "not apply the defaults of other buckets",
+			target:         "/documents/bucket-2/file.pdf?page=1",
+			path:           "bucket-2/file.pdf",
+			expectedFormat: "png",
+		},
+		{
+			message:         "apply the bucket default quality",
+			target:          "/documents/bucket-3/file.pdf?page=1",
+			path:            "bucket-3/file.pdf",
+			expectedFormat:  "jpeg",
+			expectedQuality: 80,
+		},
+		{
+			message:         "prefer the quality from the request",
+			target:          "/documents/bucket-3/file.pdf?page=1&quality=50",
+			path:            "bucket-3/file.pdf",
+			expectedFormat:  "jpeg",
+			expectedQuality: 50,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			documentService.
+				On(
+					"Process", mock.Anything, tt.target, tt.path, 1, tt.expectedWidth, float32(0), tt.expectedFormat,
+					tt.expectedQuality, mock.Anything,
+				).
+				Return(nil)
+			h := newTestHandler(&documentService)
+			h.bucketRenderDefaults = map[string]RenderDefaults{
+				"bucket-1": {Width: 800, Format: "png"},
+				"bucket-3": {Format: "jpeg", Quality: 80},
+			}
+
+			w := httptest.NewRecorder()
+			h.document(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expectedFormat, w.Header().Get("X-Chosen-Format"))
+		})
+	}
+}
+
+func TestHandlerDocumentSocial(t *testing.T) {
+	t.Parallel()
+
+	target := "/documents/bucket/file.pdf?social=true"
+	var documentService mockDocumentService
+	defer documentService.AssertExpectations(t)
+	documentService.
+		On("Cover", mock.Anything, target, "bucket/file.pdf", 1, "png", mock.Anything).
+		Return(nil)
+	h := newTestHandler(&documentService)
+
+	w := httptest.NewRecorder()
+	h.document(w, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "image/png", w.Header().Get("Content-Type"))
+}
+
+func TestHandlerPlaceholder(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	defer documentService.AssertExpectations(t)
+	documentService.
+		On("Placeholder", mock.Anything, "/documents/bucket/file.pdf?page=2&token=abc", "bucket/file.pdf", 2).
+		Return("data:image/png;base64,AAAA", nil)
+	h := newTestHandler(&documentService)
+	h.basePath = "/raster"
+
+	w := httptest.NewRecorder()
+	h.placeholder(w, httptest.NewRequest(http.MethodGet, "/raster/placeholder/bucket/file.pdf?page=2&token=abc", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(
+		t,
+		`{"Placeholder":"data:image/png;base64,AAAA","URL":"/raster/documents/bucket/file.pdf?page=2&token=abc"}`,
+		w.Body.String(),
+	)
+}
+
+func TestHandlerThumbnail(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		target        string
+		expectedWidth int
+		expectedURL   string
+		expectedCode  int
+	}{
+		{
+			message:       "render the first page with the default width",
+			target:        "/raster/thumbnail/bucket/file.pdf?token=abc",
+			expectedWidth: 150,
+			expectedURL:   "/documents/bucket/file.pdf?token=abc",
+			expectedCode:  http.StatusOK,
+		},
+		{
+			message:       "render the first page with the requested width",
+			target:        "/raster/thumbnail/bucket/file.pdf?width=300&token=abc",
+			expectedWidth: 300,
+			expectedURL:   "/documents/bucket/file.pdf?width=300&token=abc",
+			expectedCode:  http.StatusOK,
+		},
+		{
+			message:       "cap the requested width",
+			target:        "/raster/thumbnail/bucket/file.pdf?width=5000&token=abc",
+			expectedWidth: maxThumbnailWidth,
+			expectedURL:   "/documents/bucket/file.pdf?width=5000&token=abc",
+			expectedCode:  http.StatusOK,
+		},
+		{
+			message:      "reject an invalid width",
+			target:       "/raster/thumbnail/bucket/file.pdf?width=abc&token=abc",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			if tt.expectedCode == http.StatusOK {
+				documentService.
+					On(
+						"Process", mock.Anything, tt.expectedURL, "bucket/file.pdf", 1, tt.expectedWidth, float32(0), "png",
+						0, mock.Anything,
+					).
+					Return(nil)
+			}
+			h := newTestHandler(&documentService)
+			h.basePath = "/raster"
+			h.thumbnailWidth = 150
+
+			w := httptest.NewRecorder()
+			h.thumbnail(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode == http.StatusOK {
+				require.Equal(t, "image/png", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandlerContactSheet(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message      string
+		target       string
+		expectedCode int
+	}{
+		{
+			message:      "render the contact sheet with the requested parameters",
+			target:       "/contactsheet/bucket/file.pdf?columns=3&thumbWidth=100&maxPages=10&token=abc",
+			expectedCode: http.StatusOK,
+		},
+		{
+			message:      "reject an invalid parameter",
+			target:       "/contactsheet/bucket/file.pdf?columns=abc&token=abc",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			if tt.expectedCode == http.StatusOK {
+				documentService.
+					On(
+						"ContactSheet", mock.Anything, strings.Replace(tt.target, "/contactsheet/", "/documents/", 1),
+						"bucket/file.pdf", 3, 100, 10, mock.Anything,
+					).
+					Return(nil)
+			}
+			h := newTestHandler(&documentService)
+
+			w := httptest.NewRecorder()
+			h.contactSheet(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode == http.StatusOK {
+				require.Equal(t, "image/png", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandlerHealth(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.On("Stats").Return(service.WorkerStats{S3Clients: 2, OpenFiles: 1})
+	queue := newRenderQueue(2, 1)
+	require.NoError(t, queue.acquire(context.Background(), renderPriorityNormal))
+	defer queue.release()
+	h := newTestHandler(&documentService)
+	h.renderQueue = queue
+	h.inFlight = new(int64)
+
+	// The health check is requested while a document request is in flight.
+	var body string
+	handler := newTestMiddleware().countInFlight(h.inFlight)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		w := httptest.NewRecorder()
+		h.health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		body = w.Body.String()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf", nil))
+	require.JSONEq(
+		t,
+		`{"status":"healthy","inFlight":1,"openFiles":1,"s3Clients":2,"renderQueue":{"active":1,"waiting":0}}`,
+		body,
+	)
+	require.Zero(t, atomic.LoadInt64(h.inFlight))
+}
+
+func TestHandlerReady(t *testing.T) {
+	t.Parallel()
+
+	queue := newRenderQueue(1, 1)
+	require.NoError(t, queue.acquire(context.Background(), renderPriorityNormal))
+	h := newTestHandler(&mockDocumentService{})
+	h.renderQueue = queue
+	h.readinessThreshold = 1
+
+	w := httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Saturate the queue with a request waiting for the slot.
+	acquired := make(chan error)
+	go func() { acquired <- queue.acquire(context.Background(), renderPriorityNormal) }()
+	require.Eventually(t, func() bool {
+		_, waiting := queue.stats()
+		return waiting == 1
+	}, time.Second, time.Millisecond)
+
+	w = httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	queue.release()
+	require.NoError(t, <-acquired)
+	queue.release()
+
+	w = httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHandlerDocumentDebug(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message     string
+		headers     map[string]string
+		expectedLog bool
+	}{
+		{
+			message:     "log the render details when the debug header and secret are present",
+			headers:     map[string]string{"X-Debug": "true", "X-Debug-Secret": "secret"},
+			expectedLog: true,
+		},
+		{
+			message: "not log the render details without the secret",
+			headers: map[string]string{"X-Debug": "true"},
+		},
+		{
+			message: "not log the render details with a wrong secret",
+			headers: map[string]string{"X-Debug": "true", "X-Debug-Secret": "wrong"},
+		},
+		{
+			message: "not log the render details without the debug header",
+			headers: map[string]string{"X-Debug-Secret": "secret"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			documentService.
+				On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+					mock.Anything,
+				).
+				Return(nil)
+			var logs bytes.Buffer
+			h := newTestHandler(&documentService)
+			h.logger = zerolog.New(&logs).Level(zerolog.WarnLevel)
+			h.traceExtractor = func(_ context.Context, logger zerolog.Logger) (zerolog.Logger, error) {
+				return logger, nil
+			}
+			handler := newTestMiddleware().debugRequest("secret")(http.HandlerFunc(h.document))
+
+			req := httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expectedLog, strings.Contains(logs.String(), `"renderDuration"`))
+		})
+	}
+}
+
+func TestHandlerDocumentArchive(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message         string
+		pages           string
+		failPage        int
+		expectedStatus  int
+		expectedEntries []string
+		expectedAbort   bool
+	}{
+		{
+			message:         "stream the pages of the range into the archive",
+			pages:           "3-5",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{"page-3.png", "page-4.png", "page-5.png"},
+		},
+		{
+			message:         "accept a list of pages and ranges",
+			pages:           "1,4-5",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{"page-1.png", "page-4.png", "page-5.png"},
+		},
+		{
+			message:        "reject a range with more pages than the maximum",
+			pages:          "1-21",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:        "reject an invalid range",
+			pages:          "5-3",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:        "return the error when the first page fails",
+			pages:          "1-3",
+			failPage:       1,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:       "abort the response when a page fails after the archive started",
+			pages:         "1-3",
+			failPage:      2,
+			expectedAbort: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			for page := 1; page <= 5; page++ {
+				call := documentService.On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", page, 0, float32(0), "png",
+					0, mock.Anything,
+				)
+				if page == tt.failPage {
+					call.Return(service.ErrClient)
+					continue
+				}
+				page := page
+				call.
+					Run(func(args mock.Arguments) {
+						fmt.Fprintf(args.Get(8).(io.Writer), "content of page %d", page)
+					}).
+					Return(nil)
+			}
+			h := newTestHandler(&documentService)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?pages="+tt.pages, nil)
+			if tt.expectedAbort {
+				require.PanicsWithValue(t, http.ErrAbortHandler, func() { h.document(w, req) })
+				return
+			}
+			h.document(w, req)
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			require.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+			archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			require.NoError(t, err)
+			entries := make([]string, 0, len(archive.File))
+			for _, file := range archive.File {
+				entries = append(entries, file.Name)
+				content, err := file.Open()
+				require.NoError(t, err)
+				payload, err := io.ReadAll(content)
+				require.NoError(t, err)
+				page := strings.TrimSuffix(strings.TrimPrefix(file.Name, "page-"), ".png")
+				require.Equal(t, "content of page "+page, string(payload))
+			}
+			require.Equal(t, tt.expectedEntries, entries)
+		})
+	}
+}
+
+func BenchmarkHandlerDocumentContentChecksum(b *testing.B) {
+	page := bytes.Repeat([]byte("lazyraster"), 200*1024)
+	var documentService mockDocumentService
+	documentService.
+		On("Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0, mock.Anything).
+		Run(func(args mock.Arguments) { _, _ = args.Get(8).(io.Writer).Write(page) }).
+		Return(nil)
+	h := newTestHandler(&documentService)
+	h.contentChecksum = true
+	req := httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil)
+
+	b.SetBytes(int64(len(page)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.document(discardResponseWriter{header: http.Header{}}, req)
+	}
+}
+
+// discardResponseWriter keeps the benchmarks from measuring the allocations of the response recorder.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d discardResponseWriter) Header() http.Header         { return d.header }
+func (d discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponseWriter) WriteHeader(int)             {}
+
+func TestHandlerZeroBasedPages(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	for page := 1; page <= 2; page++ {
+		documentService.
+			On(
+				"Process", mock.Anything, mock.Anything, "bucket/file.pdf", page, 0, float32(0), "png", 0,
+				mock.Anything,
+			).
+			Run(reportRender(service.Render{Page: page, Format: "png"})).
+			Return(nil)
+	}
+	documentService.
+		On("Validate", mock.Anything, mock.Anything, "bucket/file.pdf").
+		Return([]service.PageValidation{{Page: 1, Valid: true}, {Page: 2, Valid: true}}, nil)
+	documentService.
+		On("Diff", mock.Anything, mock.Anything, "bucket/file.pdf", "v1", "v2", 0, mock.Anything).
+		Run(func(args mock.Arguments) {
+			changed := args.Get(6).(func(service.PageDiff) error)
+			_ = changed(service.PageDiff{Page: 2, Before: []byte("before"), After: []byte("after")})
+		}).
+		Return(nil)
+	h := newTestHandler(&documentService)
+	h.zeroBasedPages = true
+	h.defaultToFirstPage = true
+
+	serve := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	// The first page is 0 at the request and at the render parameters, with or without the page parameter.
+	for _, target := range []string{"/documents/bucket/file.pdf?page=0", "/documents/bucket/file.pdf"} {
+		w := serve(h.document, target)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "format=png&page=0&quality=0&scale=0&width=0", w.Header().Get("X-Render-Params"))
+	}
+
+	w := serve(h.document, "/documents/bucket/file.pdf?pages=0-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, archive.File, 2)
+	require.Equal(t, "page-0.png", archive.File[0].Name)
+	require.Equal(t, "page-1.png", archive.File[1].Name)
+
+	require.Equal(t, http.StatusBadRequest, serve(h.document, "/documents/bucket/file.pdf?pages=-1").Code)
+
+	w = serve(h.validate, "/validate/bucket/file.pdf")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"Valid":true,"Pages":[{"Page":0,"Valid":true},{"Page":1,"Valid":true}]}`, w.Body.String())
+
+	w = serve(h.diff, "/diff/bucket/file.pdf?from=v1&to=v2")
+	require.Equal(t, http.StatusOK, w.Code)
+	archive, err = zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, archive.File, 3)
+	require.Equal(t, "page-1-before.png", archive.File[0].Name)
+	require.Equal(t, "page-1-after.png", archive.File[1].Name)
+	require.Equal(t, "pages.json", archive.File[2].Name)
+	index, err := archive.File[2].Open()
+	require.NoError(t, err)
+	defer index.Close()
+	rawIndex, err := io.ReadAll(index)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Pages":[1]}`, string(rawIndex))
+}
+
+func TestHandlerDocumentURL(t *testing.T) {
+	t.Parallel()
+
+	// The routes rendering the document outside of '/documents/' check the token against the page route.
+	const documentURL = "/documents/bucket/file.pdf?token=abc"
+	var documentService mockDocumentService
+	defer documentService.AssertExpectations(t)
+	documentService.
+		On("Placeholder", mock.Anything, documentURL+"&page=1", "bucket/file.pdf", 1).
+		Return("data:", nil)
+	documentService.
+		On(
+			"Process", mock.Anything, documentURL, "bucket/file.pdf", 1, mock.Anything, float32(0), "png", 0,
+			mock.Anything,
+		).
+		Run(reportRender(service.Render{Page: 1, Format: "png"})).
+		Return(nil)
+	documentService.
+		On("Validate", mock.Anything, documentURL, "bucket/file.pdf").
+		Return([]service.PageValidation{}, nil)
+	documentService.
+		On("Diff", mock.Anything, documentURL, "bucket/file.pdf", "", "", 0, mock.Anything).
+		Return(nil)
+	documentService.
+		On("ContactSheet", mock.Anything, documentURL, "bucket/file.pdf", 0, 0, 0, mock.Anything).
+		Return(nil)
+	h := newTestHandler(&documentService)
+
+	for route, handler := range map[string]http.HandlerFunc{
+		"thumbnail":    h.thumbnail,
+		"validate":     h.validate,
+		"diff":         h.diff,
+		"contactsheet": h.contactSheet,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/"+route+"/bucket/file.pdf?token=abc", nil))
+		require.Equal(t, http.StatusOK, w.Code, route)
+	}
+	w := httptest.NewRecorder()
+	h.placeholder(w, httptest.NewRequest(http.MethodGet, "/placeholder/bucket/file.pdf?token=abc&page=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+// reportRender makes the mocked Process report the render to the output and write the page unless the output skips
+// it, like the service does. The outputs that aren't observers, like the pages of the archives, are always written.
+func reportRender(render service.Render) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		if observer, ok := args.Get(8).(service.RenderObserver); ok && !observer.Rendering(render) {
+			return
+		}
+		_, _ = args.Get(8).(io.Writer).Write([]byte("rendered page"))
+	}
+}
+
+func newTestHandler(documentService handlerDocumentService) handler {
+	return handler{
+		writer:          writer{logger: zerolog.Nop(), traceExtractor: nopTraceExtractor},
+		logger:          zerolog.Nop(),
+		traceExtractor:  nopTraceExtractor,
+		documentService: documentService,
+	}
+}
@@ -3,31 +3,61 @@ package transport
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+
+	"github.com/nitro/lazyraster/v2/internal/service"
 )
 
 type middleware struct {
 	log            zerolog.Logger
 	writer         writer
 	traceExtractor traceExtractor
+	basePath       string
+
+	// redactedHeaders are hidden from the logs together with the defaultRedactedHeaders.
+	redactedHeaders []string
+
+	// redactedParams are the query parameters hidden from the logs together with the defaultRedactedParams.
+	redactedParams []string
+}
+
+// defaultRedactedHeaders carry credentials and are never logged.
+var defaultRedactedHeaders = []string{
+	"Authorization", "Cookie", "Proxy-Authorization", "X-Render-Priority-Secret", "X-Debug-Secret",
+	"X-Admin-Secret",
 }
 
+// defaultRedactedParams carry credentials and are never logged.
+var defaultRedactedParams = []string{"token"}
+
+type debugContextKey struct{}
+
 func (m middleware) recoverer(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			if rvr := recover(); rvr != nil && rvr != http.ErrAbortHandler {
+			rvr := recover()
+			if rvr == http.ErrAbortHandler {
+				// The server aborts the connection, it's used when the response is already partially written.
+				panic(rvr)
+			} else if rvr != nil {
 				m.writer.error(r.Context(), w, "Internal server error", nil, http.StatusInternalServerError)
 			}
 		}()
@@ -62,24 +92,20 @@ func (m middleware) limitReader(limit int64) func(http.Handler) http.Handler {
 
 func (m middleware) logger(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI == "/health" {
+		switch r.RequestURI {
+		case m.basePath + "/health", m.basePath + "/readyz", m.basePath + "/metrics":
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		requestURI := r.RequestURI
-		if token := r.URL.Query().Get("token"); token != "" {
-			requestURI = strings.ReplaceAll(requestURI, token, "[REDACTED]")
-		}
-		if strings.HasPrefix(requestURI, "/documents/dropbox/") {
-			requestURI = "/documents/dropbox/[REDACTED]"
-		}
+		requestURI := m.redactDropboxPath(m.redactQuery(r.RequestURI))
 
 		log, err := m.traceExtractor(r.Context(), m.log)
 		if err != nil {
 			m.writer.error(r.Context(), w, "Could not extract tracing id", nil, http.StatusInternalServerError)
 			return
 		}
+		log = requestLogger(r.Context(), log)
 
 		t1 := time.Now()
 		reqID := chiMiddleware.GetReqID(r.Context())
@@ -87,7 +113,8 @@ func (m middleware) logger(next http.Handler) http.Handler {
 			Str("requestID", reqID).
 			Str("method", r.Method).
 			Str("endpoint", requestURI).
-			Str("protocol", r.Proto)
+			Str("protocol", r.Proto).
+			Dict("headers", m.headers(r.Header))
 		if r.RemoteAddr != "" {
 			entry = entry.Str("ip", r.RemoteAddr)
 		}
@@ -132,12 +159,158 @@ func (m middleware) logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// debugRequest flags the requests with the header 'X-Debug: true' and a 'X-Debug-Secret' matching the secret. The
+// flagged requests log their details at the debug level, so a single request can be debugged without changing the
+// global log level.
+func (m middleware) debugRequest(secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			given := r.Header.Get("X-Debug-Secret")
+			if r.Header.Get("X-Debug") == "true" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1 {
+				r = r.WithContext(context.WithValue(r.Context(), debugContextKey{}, true))
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// bypassCache flags the requests with 'bypassCache=true' to skip the service cache, forcing a fresh fetch of the
+// document.
+func (m middleware) bypassCache(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("bypassCache") == "true" {
+			r = r.WithContext(service.WithBypassCache(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// requireAdmin rejects the requests without the secret at the 'X-Admin-Secret' header.
+func (m middleware) requireAdmin(secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			given := r.Header.Get("X-Admin-Secret")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+				m.writer.error(r.Context(), w, "Unauthorized", nil, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func debugging(ctx context.Context) bool {
+	debug, _ := ctx.Value(debugContextKey{}).(bool)
+	return debug
+}
+
+// requestLogger returns the logger used to log the request details. The requests being debugged log at the debug
+// level whatever the configured level is, so the logger sampler is removed as well.
+func requestLogger(ctx context.Context, logger zerolog.Logger) zerolog.Logger {
+	if debugging(ctx) {
+		return logger.Level(zerolog.DebugLevel).Sample(nil)
+	}
+	return logger
+}
+
+// headers returns the request headers to be logged. Every path that logs headers must go through here so the
+// sensitive ones are redacted.
+func (m middleware) headers(header http.Header) *zerolog.Event {
+	result := zerolog.Dict()
+	for key, values := range header {
+		value := strings.Join(values, ", ")
+		if m.redactedHeader(key) {
+			value = "[REDACTED]"
+		}
+		result = result.Str(key, value)
+	}
+	return result
+}
+
+func (m middleware) redactedHeader(key string) bool {
+	for _, headers := range [][]string{defaultRedactedHeaders, m.redactedHeaders} {
+		for _, header := range headers {
+			if strings.EqualFold(header, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactQuery hides the values of the sensitive query parameters. The parameters are kept in the same order and
+// encoding, only the values are replaced.
+func (m middleware) redactQuery(requestURI string) string {
+	index := strings.IndexByte(requestURI, '?')
+	if index < 0 {
+		return requestURI
+	}
+	params := strings.Split(requestURI[index+1:], "&")
+	for i, param := range params {
+		rawKey := strings.SplitN(param, "=", 2)[0]
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if m.redactedParam(key) {
+			params[i] = rawKey + "=[REDACTED]"
+		}
+	}
+	return requestURI[:index+1] + strings.Join(params, "&")
+}
+
+func (m middleware) redactedParam(key string) bool {
+	for _, params := range [][]string{defaultRedactedParams, m.redactedParams} {
+		for _, param := range params {
+			if param == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactDropboxPath hides the Dropbox file URL, that is encoded at the path, from the routes that accept it.
+func (m middleware) redactDropboxPath(path string) string {
+	if route := m.dropboxRoute(path); route != "" {
+		return route + "[REDACTED]"
+	}
+	return path
+}
+
+func (m middleware) dropboxRoute(path string) string {
+	routes := []string{
+		"/documents/dropbox/", "/placeholder/dropbox/", "/diff/dropbox/", "/validate/dropbox/", "/thumbnail/dropbox/",
+		"/contactsheet/dropbox/",
+	}
+	for _, route := range routes {
+		if strings.HasPrefix(path, m.basePath+route) {
+			return m.basePath + route
+		}
+	}
+	return ""
+}
+
+// stripSlashes removes the trailing slashes from the path, except for the Dropbox routes. The Dropbox file URL is
+// encoded as base64 at the path and a trailing slash can be part of the encoded value.
+func (m middleware) stripSlashes(next http.Handler) http.Handler {
+	strip := chiMiddleware.StripSlashes(next)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if m.dropboxRoute(r.URL.Path) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 func (m middleware) datadogTracer(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/documents/dropbox/") {
-			path = "/documents/dropbox/[REDACTED]"
-		}
+		path := m.redactDropboxPath(r.URL.Path)
 
 		opts := []ddtrace.StartSpanOption{
 			tracer.SpanType(ext.SpanTypeWeb),
@@ -160,6 +333,9 @@ func (m middleware) datadogTracer(next http.Handler) http.Handler {
 		}
 		resourceName = r.Method + " " + resourceName
 
+		// Besides the trace propagation, this header is the only one read by the tracer. No header should be tagged at
+		// the span without going through the same redaction used by the logs.
+		//
 		// If the header 'datadog-resource-prefix' is present the value will be prefixed at the resource name
 		// that is set at the span sent to Datadog.
 		resourcePrefix := r.Header.Get("datadog-resource-prefix")
@@ -183,6 +359,173 @@ func (m middleware) datadogTracer(next http.Handler) http.Handler {
 	})
 }
 
+// limitConcurrency executes the request only after acquiring a render slot from the queue. Requests beyond the queue
+// capacity are answered with 429 right away.
+//
+// The header 'X-Render-Priority' can be set to 'high', 'normal' or 'low' to change the order the waiting requests are
+// scheduled. When prioritySecret is set the header is only honored if 'X-Render-Priority-Secret' matches it.
+func (m middleware) limitConcurrency(queue *renderQueue, prioritySecret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			err := queue.acquire(r.Context(), renderPriority(r, prioritySecret))
+			if span, ok := tracer.SpanFromContext(r.Context()); ok {
+				active, waiting := queue.stats()
+				span.SetTag("renderQueue.active", active)
+				span.SetTag("renderQueue.waiting", waiting)
+			}
+			if errors.Is(err, errRenderQueueFull) {
+				m.writer.error(r.Context(), w, "Too many requests", nil, http.StatusTooManyRequests)
+				return
+			} else if errors.Is(err, context.Canceled) {
+				return
+			} else if err != nil {
+				m.writer.errorWithReason(r.Context(), w, "Request timeout", "request_timeout", nil, http.StatusGatewayTimeout)
+				return
+			}
+			defer queue.release()
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// rejectDraining answers with 503 once the server starts to shut down, the requests already in-flight aren't affected.
+func (m middleware) rejectDraining(draining *int32) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(draining) == 1 {
+				w.Header().Set("Connection", "close")
+				m.writer.error(r.Context(), w, "Server is shutting down", nil, http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// countInFlight keeps the counter updated with the quantity of requests being processed.
+func (m middleware) countInFlight(counter *int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(counter, 1)
+			defer atomic.AddInt64(counter, -1)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// countRequests increments the counter of requests by route and status. The route pattern is used instead of the path
+// to keep the quantity of series bounded.
+func (m middleware) countRequests(counter *prometheus.CounterVec) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ww := chiMiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			counter.WithLabelValues(chi.RouteContext(r.Context()).RoutePattern(), strconv.Itoa(status)).Inc()
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// limitClientRate answers 429 when the client exceeds its request rate. The client is identified by the IP set by the
+// RealIP middleware.
+func (m middleware) limitClientRate(limiter *clientRateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			client := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(client); err == nil {
+				client = host
+			}
+			if !limiter.allow(client) {
+				w.Header().Set("Retry-After", "1")
+				m.writer.error(r.Context(), w, "Too many requests", nil, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// limitDocumentConcurrency answers 503 when the document already has all its render slots taken. The document is
+// identified by the path matched by the route wildcard.
+func (m middleware) limitDocumentConcurrency(limiter *documentLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			document := chi.URLParam(r, "*")
+			if !limiter.acquire(document) {
+				m.writer.error(r.Context(), w, "Too many renders of the document", nil, http.StatusServiceUnavailable)
+				return
+			}
+			defer limiter.release(document)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func renderPriority(r *http.Request, secret string) int {
+	if secret != "" {
+		given := r.Header.Get("X-Render-Priority-Secret")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+			return renderPriorityNormal
+		}
+	}
+	switch r.Header.Get("X-Render-Priority") {
+	case "high":
+		return renderPriorityHigh
+	case "low":
+		return renderPriorityLow
+	default:
+		return renderPriorityNormal
+	}
+}
+
+// cors sets the header that allows the response to be read by the browser when the request origin is allowed.
+func (m middleware) cors(allowedOrigins []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if origin := allowedOrigin(allowedOrigins, r.Header.Get("Origin")); origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func allowedOrigin(allowedOrigins []string, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// noCache keeps the responses from being cached by the clients and the proxies. Unlike chi's NoCache the conditional
+// request headers are kept, the rendered pages use them to answer with 304.
+func (m middleware) noCache(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Expires", "Thu, 01 Jan 1970 00:00:00 UTC")
+		w.Header().Set("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("X-Accel-Expires", "0")
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 func (m middleware) timeout(duration time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
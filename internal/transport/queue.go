@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var errRenderQueueFull = errors.New("render queue is full")
+
+// The render priorities, waiting requests with a higher priority are scheduled first.
+const (
+	renderPriorityLow = iota
+	renderPriorityNormal
+	renderPriorityHigh
+)
+
+// renderQueue bounds the number of concurrent renders. Requests that can't be executed right away wait in a queue of
+// limited depth, when the queue is full the request is rejected instead of piling up.
+type renderQueue struct {
+	concurrency int
+	maxWaiting  int
+
+	mutex   sync.Mutex
+	active  int
+	waiters []renderQueueWaiter
+}
+
+type renderQueueWaiter struct {
+	ready    chan struct{}
+	priority int
+}
+
+func newRenderQueue(concurrency, maxWaiting int) *renderQueue {
+	return &renderQueue{concurrency: concurrency, maxWaiting: maxWaiting}
+}
+
+// acquire a render slot. Every successful call must be followed by a call to release. Waiting requests are ordered by
+// priority and then by arrival.
+func (q *renderQueue) acquire(ctx context.Context, priority int) error {
+	q.mutex.Lock()
+	if q.active < q.concurrency {
+		q.active++
+		q.mutex.Unlock()
+		return nil
+	}
+	if len(q.waiters) >= q.maxWaiting {
+		q.mutex.Unlock()
+		return errRenderQueueFull
+	}
+	ready := make(chan struct{})
+	q.enqueue(renderQueueWaiter{ready: ready, priority: priority})
+	q.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, waiter := range q.waiters {
+		if waiter.ready == ready {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// The slot was handed over at the same time the context finished, so it needs to be passed along.
+	q.releaseLocked()
+	return ctx.Err()
+}
+
+// release a render slot, handing it over to the next waiting request if there is any.
+func (q *renderQueue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.releaseLocked()
+}
+
+func (q *renderQueue) releaseLocked() {
+	// When the concurrency was reduced the slot is dropped until the active renders fit the new limit.
+	if len(q.waiters) == 0 || q.active > q.concurrency {
+		q.active--
+		return
+	}
+	waiter := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(waiter.ready)
+}
+
+// resize changes the queue limits. The requests already running or waiting aren't affected, when the concurrency grows
+// the waiting requests are scheduled right away.
+func (q *renderQueue) resize(concurrency, maxWaiting int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.concurrency, q.maxWaiting = concurrency, maxWaiting
+	for q.active < q.concurrency && len(q.waiters) > 0 {
+		q.active++
+		waiter := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		close(waiter.ready)
+	}
+}
+
+func (q *renderQueue) enqueue(waiter renderQueueWaiter) {
+	position := len(q.waiters)
+	for i, w := range q.waiters {
+		if w.priority < waiter.priority {
+			position = i
+			break
+		}
+	}
+	q.waiters = append(q.waiters, renderQueueWaiter{})
+	copy(q.waiters[position+1:], q.waiters[position:])
+	q.waiters[position] = waiter
+}
+
+// stats return the quantity of renders running and waiting.
+func (q *renderQueue) stats() (active, waiting int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.active, len(q.waiters)
+}
+
+// documentLimiter bounds the concurrent renders of each document, so a single popular document can't take all the
+// render slots.
+type documentLimiter struct {
+	limit int
+
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+func newDocumentLimiter(limit int) *documentLimiter {
+	return &documentLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// acquire a render slot for the document, it returns false when all the slots are taken. Every successful call must
+// be followed by a call to release.
+func (l *documentLimiter) acquire(document string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[document] >= l.limit {
+		return false
+	}
+	l.active[document]++
+	return true
+}
+
+// resize changes the limit, the documents already over it keep their renders until they're released.
+func (l *documentLimiter) resize(limit int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+}
+
+func (l *documentLimiter) release(document string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[document] <= 1 {
+		delete(l.active, document)
+		return
+	}
+	l.active[document]--
+}
+
+// clientRateIdleTimeout is how long the bucket of a client is kept after its last request.
+const clientRateIdleTimeout = 3 * time.Minute
+
+// clientRateLimiter is a token bucket per client, so a single client can't take all the render capacity. The buckets
+// of the clients that stopped sending requests are dropped from time to time to keep the memory bounded.
+type clientRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mutex       sync.Mutex
+	clients     map[string]*clientRate
+	lastCleanup time.Time
+}
+
+type clientRate struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimiter(limit float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:       rate.Limit(limit),
+		burst:       burst,
+		clients:     make(map[string]*clientRate),
+		lastCleanup: time.Now(),
+	}
+}
+
+// resize changes the rate and burst of every client, the tokens already in the buckets are kept.
+func (l *clientRateLimiter) resize(limit float64, burst int) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit, l.burst = rate.Limit(limit), burst
+	for _, c := range l.clients {
+		c.limiter.SetLimitAt(now, l.limit)
+		c.limiter.SetBurstAt(now, l.burst)
+	}
+}
+
+// allow reports if the client can make a request now, consuming a token from its bucket.
+func (l *clientRateLimiter) allow(client string) bool {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastCleanup) > clientRateIdleTimeout {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > clientRateIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientRate{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	return c.limiter.AllowN(now, 1)
+}
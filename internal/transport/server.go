@@ -2,13 +2,20 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 )
 
@@ -19,9 +26,124 @@ type Server struct {
 	TraceExtractor    traceExtractor
 	DocumentService   handlerDocumentService
 
-	writer writer
-	server http.Server
-	router chi.Mux
+	// BasePath is prefixed to every route, it's used when the service is hosted under a shared ingress. An empty value
+	// means the routes are served from the root.
+	BasePath string
+
+	// DefaultToFirstPage renders the first page when the page parameter is omitted instead of returning the document
+	// metadata. The metadata can still be fetched with 'metadata=true'.
+	DefaultToFirstPage bool
+
+	// ZeroBasedPages numbers the first page of the documents as 0 at the requests and responses, instead of the default
+	// 1. A page before the first one is rejected in both cases.
+	ZeroBasedPages bool
+
+	// BucketRenderDefaults are the render parameters used when the request omits them, keyed by the bucket. The
+	// parameters sent by the client always win.
+	BucketRenderDefaults map[string]RenderDefaults
+
+	// ContentChecksum adds the header X-Content-SHA256 with the checksum of the rendered page.
+	ContentChecksum bool
+
+	// MaxConcurrentRenders bounds how many document requests are executed at the same time, zero means unlimited.
+	// Requests beyond this limit wait in a queue of RenderQueueDepth, when the queue is full they get a 429.
+	MaxConcurrentRenders int
+	RenderQueueDepth     int
+
+	// RenderPrioritySecret, when set, is required at the 'X-Render-Priority-Secret' header for the render priority
+	// header to be honored. Otherwise the priority is always honored.
+	RenderPrioritySecret string
+
+	// ReadinessQueueThreshold makes '/readyz' report not ready when at least this quantity of requests are waiting for
+	// a render slot, so the balancer sheds the load. Zero disables the check and it requires MaxConcurrentRenders.
+	// '/health' is always healthy to avoid restart loops.
+	ReadinessQueueThreshold int
+
+	// RateLimit bounds the document requests per second of each client, identified by the IP. The client can go over
+	// the rate up to RateLimitBurst requests, which defaults to the rate rounded up. Beyond that the requests get a
+	// 429. Zero disables the limit.
+	RateLimit      float64
+	RateLimitBurst int
+
+	// MaxDocumentRenders bounds the concurrent renders of the same document, the requests beyond it get a 503. Zero
+	// means unlimited.
+	MaxDocumentRenders int
+
+	// ThumbnailWidth is the width of the pages rendered by the '/thumbnail/' route, defaults to 150. The requests can
+	// override it up to 600.
+	ThumbnailWidth int
+
+	// DebugSecret enables the per request debugging, the requests with 'X-Debug: true' and the secret at
+	// 'X-Debug-Secret' log their details as if the log level was debug. Empty disables it.
+	DebugSecret string
+
+	// AdminSecret enables the admin routes for the requests with the secret at the 'X-Admin-Secret' header: '/sign'
+	// generates signed URLs and '/cache' lists the cached documents, or purges them with DELETE. Empty disables the
+	// routes.
+	AdminSecret string
+
+	// CORSAllowedOrigins is the list of origins allowed to access the document routes from the browser, '*' allows any
+	// origin.
+	CORSAllowedOrigins []string
+
+	// LogRedactedHeaders are the request headers, besides the default ones, that have their values hidden from the
+	// logs.
+	LogRedactedHeaders []string
+
+	// LogRedactedParams are the query parameters, besides 'token', that have their values hidden from the logs.
+	LogRedactedParams []string
+
+	// Port the server listens on, defaults to 8080.
+	Port int
+
+	// The timeouts of the HTTP server, a zero value means the default: 10 seconds to read and write the requests and 30
+	// seconds for idle connections.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// RequestTimeout bounds the processing of a request, defaults to 5 seconds. Once it's reached the render is canceled
+	// and the request is answered with 504. It should be lower than the WriteTimeout, otherwise the connection is closed
+	// before the answer is written.
+	RequestTimeout time.Duration
+
+	// MaxHeaderBytes bounds the size of the request headers, including the request line with the URL, defaults to
+	// 100kb. Bigger requests are rejected with 431.
+	MaxHeaderBytes int
+
+	// CompressionLevel is used to compress the responses, from 1 (faster) to 9 (smaller), defaults to 5.
+	// CompressedContentTypes restricts the compression to these content types, by default the textual ones are
+	// compressed. The rendered pages are already compressed images and compressing them again only wastes CPU.
+	CompressionLevel       int
+	CompressedContentTypes []string
+
+	// MetricsRegistry, when set, receives the Prometheus collectors of the document requests and it's exposed at
+	// '/metrics'.
+	MetricsRegistry *prometheus.Registry
+
+	// When both TLSCertFile and TLSKeyFile are set the server terminates TLS itself, otherwise it listens in plaintext.
+	// TLSMinVersion defaults to TLS 1.2 and can't be set to anything lower than that.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+
+	writer            writer
+	documentLimiter   *documentLimiter
+	clientRateLimiter *clientRateLimiter
+	inFlight          int64
+	draining          int32
+	requestsTotal     *prometheus.CounterVec
+	server            http.Server
+	router            chi.Mux
+	renderQueue       *renderQueue
+}
+
+// RenderDefaults holds the render parameters applied to a bucket when the request doesn't set them. The zero values
+// keep the service defaults.
+type RenderDefaults struct {
+	Width   int
+	Format  string
+	Quality int
 }
 
 // Init the server internal state.
@@ -35,56 +157,246 @@ func (s *Server) Init() error {
 	if s.DocumentService == nil {
 		return errors.New("internal/transport.Server.DocumentService can't be nil")
 	}
+	if s.BasePath != "" && (!strings.HasPrefix(s.BasePath, "/") || strings.HasSuffix(s.BasePath, "/")) {
+		return errors.New("internal/transport.Server.BasePath must start with a slash and can't end with one")
+	}
+	if s.MaxConcurrentRenders < 0 {
+		return errors.New("internal/transport.Server.MaxConcurrentRenders can't be negative")
+	}
+	if s.RenderQueueDepth < 0 {
+		return errors.New("internal/transport.Server.RenderQueueDepth can't be negative")
+	}
+	if s.ReadinessQueueThreshold < 0 {
+		return errors.New("internal/transport.Server.ReadinessQueueThreshold can't be negative")
+	} else if s.ReadinessQueueThreshold > 0 && s.MaxConcurrentRenders == 0 {
+		return errors.New("internal/transport.Server.ReadinessQueueThreshold requires MaxConcurrentRenders")
+	}
+	if s.RateLimit < 0 {
+		return errors.New("internal/transport.Server.RateLimit can't be negative")
+	}
+	if s.RateLimitBurst < 0 {
+		return errors.New("internal/transport.Server.RateLimitBurst can't be negative")
+	} else if s.RateLimitBurst == 0 {
+		s.RateLimitBurst = int(math.Ceil(s.RateLimit))
+	}
+	if s.RateLimit > 0 {
+		s.clientRateLimiter = newClientRateLimiter(s.RateLimit, s.RateLimitBurst)
+	}
+	if s.MaxDocumentRenders < 0 {
+		return errors.New("internal/transport.Server.MaxDocumentRenders can't be negative")
+	} else if s.MaxDocumentRenders > 0 {
+		s.documentLimiter = newDocumentLimiter(s.MaxDocumentRenders)
+	}
+	if s.MaxConcurrentRenders > 0 {
+		s.renderQueue = newRenderQueue(s.MaxConcurrentRenders, s.RenderQueueDepth)
+	}
+	for bucket, defaults := range s.BucketRenderDefaults {
+		if defaults.Width < 0 {
+			return fmt.Errorf(
+				"internal/transport.Server.BucketRenderDefaults width of bucket '%s' can't be negative", bucket,
+			)
+		}
+		if _, ok := formatContentType(defaults.Format); defaults.Format != "" && !ok {
+			return fmt.Errorf(
+				"internal/transport.Server.BucketRenderDefaults format '%s' of bucket '%s' isn't supported",
+				defaults.Format, bucket,
+			)
+		}
+		if defaults.Quality < 0 || defaults.Quality > 100 {
+			return fmt.Errorf(
+				"internal/transport.Server.BucketRenderDefaults quality of bucket '%s' must be between 0 and 100",
+				bucket,
+			)
+		}
+	}
+	if s.ThumbnailWidth < 0 || s.ThumbnailWidth > maxThumbnailWidth {
+		return fmt.Errorf("internal/transport.Server.ThumbnailWidth must be between 0 and %d", maxThumbnailWidth)
+	} else if s.ThumbnailWidth == 0 {
+		s.ThumbnailWidth = defaultThumbnailWidth
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return errors.New("internal/transport.Server.Port must be between 0 and 65535")
+	} else if s.Port == 0 {
+		s.Port = defaultPort
+	}
+	if s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		return errors.New("internal/transport.Server timeouts can't be negative")
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = defaultReadTimeout
+	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = defaultWriteTimeout
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = defaultIdleTimeout
+	}
+	if s.RequestTimeout < 0 {
+		return errors.New("internal/transport.Server.RequestTimeout can't be negative")
+	} else if s.RequestTimeout == 0 {
+		s.RequestTimeout = defaultRequestTimeout
+	}
+	if s.MaxHeaderBytes < 0 {
+		return errors.New("internal/transport.Server.MaxHeaderBytes can't be negative")
+	} else if s.MaxHeaderBytes == 0 {
+		s.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if s.CompressionLevel < 0 || s.CompressionLevel > 9 {
+		return errors.New("internal/transport.Server.CompressionLevel must be between 0 and 9")
+	} else if s.CompressionLevel == 0 {
+		s.CompressionLevel = defaultCompressionLevel
+	}
+	if s.MetricsRegistry != nil {
+		s.requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lazyraster_http_requests_total",
+			Help: "Quantity of document requests by route and status.",
+		}, []string{"route", "status"})
+		if err := s.MetricsRegistry.Register(s.requestsTotal); err != nil {
+			return fmt.Errorf("internal/transport.Server.MetricsRegistry is invalid: %w", err)
+		}
+	}
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return errors.New("internal/transport.Server.TLSCertFile and TLSKeyFile must be set together")
+	}
+	if s.TLSMinVersion == 0 {
+		s.TLSMinVersion = tls.VersionTLS12
+	} else if s.TLSMinVersion < tls.VersionTLS12 {
+		return errors.New("internal/transport.Server.TLSMinVersion can't be lower than TLS 1.2")
+	}
+	return nil
+}
+
+// SetRenderLimits changes the render concurrency and queue depth while the server is running. The queue can only be
+// resized, enabling or disabling it requires a restart.
+func (s *Server) SetRenderLimits(maxConcurrentRenders, renderQueueDepth int) error {
+	if s.renderQueue == nil {
+		return errors.New("the render queue is disabled, enabling it requires a restart")
+	}
+	if maxConcurrentRenders <= 0 {
+		return errors.New("the max concurrent renders must be bigger than zero")
+	}
+	if renderQueueDepth < 0 {
+		return errors.New("the render queue depth can't be negative")
+	}
+	s.renderQueue.resize(maxConcurrentRenders, renderQueueDepth)
+	return nil
+}
+
+// SetRateLimit changes the rate and burst of the client rate limit while the server is running. A zero burst defaults
+// to the rate rounded up. Enabling or disabling the rate limit requires a restart.
+func (s *Server) SetRateLimit(rateLimit float64, rateLimitBurst int) error {
+	if s.clientRateLimiter == nil {
+		return errors.New("the rate limit is disabled, enabling it requires a restart")
+	}
+	if rateLimit <= 0 {
+		return errors.New("the rate limit must be bigger than zero")
+	}
+	if rateLimitBurst < 0 {
+		return errors.New("the rate limit burst can't be negative")
+	} else if rateLimitBurst == 0 {
+		rateLimitBurst = int(math.Ceil(rateLimit))
+	}
+	s.clientRateLimiter.resize(rateLimit, rateLimitBurst)
+	return nil
+}
+
+// SetMaxDocumentRenders changes the concurrent renders of the same document while the server is running. Enabling or
+// disabling the limit requires a restart.
+func (s *Server) SetMaxDocumentRenders(maxDocumentRenders int) error {
+	if s.documentLimiter == nil {
+		return errors.New("the document render limit is disabled, enabling it requires a restart")
+	}
+	if maxDocumentRenders <= 0 {
+		return errors.New("the max document renders must be bigger than zero")
+	}
+	s.documentLimiter.resize(maxDocumentRenders)
 	return nil
 }
 
 // Start the server.
 func (s *Server) Start() {
-	s.router = *chi.NewRouter()
-	s.writer.logger = s.Logger
-	s.writer.traceExtractor = s.TraceExtractor
-	s.initMiddleware()
-	s.initHandler()
+	s.initRouter()
 
-	// The HTTP server uses a static configuration. In the case that we need to change this setting in the future, we
-	// could consider moving it to a configuration file.
 	s.server = http.Server{
-		ReadTimeout:       10 * time.Second,
+		ReadTimeout:       s.ReadTimeout,
 		ReadHeaderTimeout: 20 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		MaxHeaderBytes:    maxBodySize,
-		Addr:              ":8080",
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+		Addr:              ":" + strconv.Itoa(s.Port),
 		Handler:           &s.router,
 	}
+	if s.tlsEnabled() {
+		s.server.TLSConfig = s.tlsConfig()
+	}
 
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.tlsEnabled() {
+			err = s.server.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			s.AsyncErrorHandler(fmt.Errorf("fail to start the http server: %w", err))
 		}
 	}()
 }
 
-// Stop the server.
+// Stop the server. The document requests are rejected from now on while the in-flight ones are given until the context
+// is done to finish.
 func (s *Server) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.Logger.Info().Int64("inFlight", atomic.LoadInt64(&s.inFlight)).Msg("Draining the in-flight requests")
 	if err := s.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("fail to close the http server: %w", err)
 	}
 	return nil
 }
 
+func (s *Server) initRouter() {
+	s.router = *chi.NewRouter()
+	s.writer.logger = s.Logger
+	s.writer.traceExtractor = s.TraceExtractor
+	s.initMiddleware()
+	s.initHandler()
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.TLSCertFile != ""
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: s.TLSMinVersion}
+}
+
+func (s *Server) middleware() middleware {
+	return middleware{
+		log:             s.Logger,
+		writer:          s.writer,
+		traceExtractor:  s.TraceExtractor,
+		basePath:        s.BasePath,
+		redactedHeaders: s.LogRedactedHeaders,
+		redactedParams:  s.LogRedactedParams,
+	}
+}
+
 func (s *Server) initMiddleware() {
-	m := middleware{log: s.Logger, writer: s.writer, traceExtractor: s.TraceExtractor}
+	m := s.middleware()
 	s.router.Use(m.recoverer)
-	s.router.Use(m.timeout(5 * time.Second))
+	s.router.Use(m.timeout(s.RequestTimeout))
 	s.router.Use(m.datadogTracer)
-	s.router.Use(chiMiddleware.NoCache)
+	s.router.Use(m.noCache)
 	s.router.Use(chiMiddleware.RealIP)
 	s.router.Use(chiMiddleware.RequestID)
-	s.router.Use(chiMiddleware.StripSlashes)
-	s.router.Use(chiMiddleware.NewCompressor(5).Handler)
+	s.router.Use(m.stripSlashes)
+	s.router.Use(chiMiddleware.NewCompressor(s.CompressionLevel, s.CompressedContentTypes...).Handler)
+	if s.DebugSecret != "" {
+		s.router.Use(m.debugRequest(s.DebugSecret))
+	}
 	s.router.Use(m.logger)
 	s.router.Use(m.limitReader(maxBodySize))
+	s.router.Use(m.bypassCache)
 }
 
 func (s *Server) initHandler() {
@@ -93,11 +405,76 @@ func (s *Server) initHandler() {
 		logger:          s.Logger,
 		traceExtractor:  s.TraceExtractor,
 		documentService: s.DocumentService,
+		basePath:        s.BasePath,
+
+		defaultToFirstPage:   s.DefaultToFirstPage,
+		zeroBasedPages:       s.ZeroBasedPages,
+		contentChecksum:      s.ContentChecksum,
+		bucketRenderDefaults: s.BucketRenderDefaults,
+		thumbnailWidth:       s.ThumbnailWidth,
+		renderQueue:          s.renderQueue,
+		readinessThreshold:   s.ReadinessQueueThreshold,
+		inFlight:             &s.inFlight,
+		draining:             &s.draining,
 	}
 
 	s.router.MethodNotAllowed(h.methodNotAllowed)
 	s.router.NotFound(h.notFound)
-	s.router.Get("/health", h.health)
-	s.router.Get("/documents/dropbox/*", h.document)
-	s.router.Get("/documents/*", h.document)
+
+	// The not found and method not allowed handlers need to be set before mounting the sub router, this way chi can
+	// propagate them.
+	router := chi.Router(&s.router)
+	if s.BasePath != "" {
+		router = chi.NewRouter()
+		s.router.Mount(s.BasePath, router)
+	}
+	router.Get("/health", h.health)
+	router.Get("/readyz", h.ready)
+	if s.MetricsRegistry != nil {
+		router.Handle("/metrics", promhttp.HandlerFor(s.MetricsRegistry, promhttp.HandlerOpts{}))
+	}
+	if s.AdminSecret != "" {
+		router.Group(func(router chi.Router) {
+			router.Use(s.middleware().requireAdmin(s.AdminSecret))
+			router.Get("/sign", h.sign)
+			router.Get("/cache", h.listCache)
+			router.Delete("/cache", h.purgeCache)
+		})
+	}
+
+	router.Group(func(router chi.Router) {
+		router.Use(s.middleware().cors(s.CORSAllowedOrigins))
+		router.Options("/documents/dropbox/*", h.preflight)
+		router.Options("/documents/*", h.preflight)
+		router.Options("/placeholder/*", h.preflight)
+		router.Options("/thumbnail/*", h.preflight)
+		router.Options("/diff/*", h.preflight)
+		router.Options("/validate/*", h.preflight)
+		router.Options("/contactsheet/*", h.preflight)
+
+		// The rate and document limits are checked first, there is no reason to wait for a render slot to be rejected
+		// later.
+		documentRouter := router.With(
+			s.middleware().rejectDraining(&s.draining), s.middleware().countInFlight(&s.inFlight),
+		)
+		if s.requestsTotal != nil {
+			documentRouter = documentRouter.With(s.middleware().countRequests(s.requestsTotal))
+		}
+		if s.clientRateLimiter != nil {
+			documentRouter = documentRouter.With(s.middleware().limitClientRate(s.clientRateLimiter))
+		}
+		if s.documentLimiter != nil {
+			documentRouter = documentRouter.With(s.middleware().limitDocumentConcurrency(s.documentLimiter))
+		}
+		if s.renderQueue != nil {
+			documentRouter = documentRouter.With(s.middleware().limitConcurrency(s.renderQueue, s.RenderPrioritySecret))
+		}
+		documentRouter.Get("/documents/dropbox/*", h.document)
+		documentRouter.Get("/documents/*", h.document)
+		documentRouter.Get("/placeholder/*", h.placeholder)
+		documentRouter.Get("/thumbnail/*", h.thumbnail)
+		documentRouter.Get("/diff/*", h.diff)
+		documentRouter.Get("/validate/*", h.validate)
+		documentRouter.Get("/contactsheet/*", h.contactSheet)
+	})
 }
@@ -0,0 +1,964 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nitro/lazyraster/v2/internal/service"
+)
+
+func TestServerTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message    string
+		minVersion uint16
+		clientTLS  uint16
+		shouldFail bool
+	}{
+		{
+			message:    "reject TLS 1.0",
+			clientTLS:  tls.VersionTLS10,
+			shouldFail: true,
+		},
+		{
+			message:    "reject TLS 1.1",
+			clientTLS:  tls.VersionTLS11,
+			shouldFail: true,
+		},
+		{
+			message:   "accept TLS 1.2",
+			clientTLS: tls.VersionTLS12,
+		},
+		{
+			message:    "reject TLS 1.2 when the minimum is TLS 1.3",
+			minVersion: tls.VersionTLS13,
+			clientTLS:  tls.VersionTLS12,
+			shouldFail: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			s := Server{
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &mockDocumentService{},
+				TLSCertFile:       "cert.pem",
+				TLSKeyFile:        "key.pem",
+				TLSMinVersion:     tt.minVersion,
+			}
+			require.NoError(t, s.Init())
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			ts.TLS = s.tlsConfig()
+			ts.StartTLS()
+			defer ts.Close()
+
+			client := http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: true, // nolint: gosec
+						MinVersion:         tt.clientTLS,
+						MaxVersion:         tt.clientTLS,
+					},
+				},
+			}
+			resp, err := client.Get(ts.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			require.Equal(t, tt.shouldFail, err != nil)
+		})
+	}
+}
+
+func TestServerPort(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.On("Stats").Return(service.WorkerStats{})
+
+	port := freePort(t)
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(err error) { t.Errorf("unexpected server error: %s", err) },
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		Port:              port,
+	}
+	require.NoError(t, s.Init())
+	s.Start()
+	defer func() { require.NoError(t, s.Stop(context.Background())) }()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.
+		On("Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0, mock.Anything).
+		Run(func(mock.Arguments) { time.Sleep(200 * time.Millisecond) }).
+		Return(nil)
+	documentService.On("Stats").Return(service.WorkerStats{})
+
+	port := freePort(t)
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(err error) { t.Errorf("unexpected server error: %s", err) },
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		Port:              port,
+		WriteTimeout:      50 * time.Millisecond,
+	}
+	require.NoError(t, s.Init())
+	s.Start()
+	defer func() { require.NoError(t, s.Stop(context.Background())) }()
+
+	// The health check answers within the timeout and is used to wait for the server to start.
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/documents/bucket/file.pdf?page=1", port))
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+}
+
+func TestServerMaxHeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.On("Stats").Return(service.WorkerStats{})
+
+	port := freePort(t)
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(err error) { t.Errorf("unexpected server error: %s", err) },
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		Port:              port,
+		MaxHeaderBytes:    1024,
+	}
+	require.NoError(t, s.Init())
+	s.Start()
+	defer func() { require.NoError(t, s.Stop(context.Background())) }()
+
+	request := func(headerSize int) int {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/health", port), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Padding", strings.Repeat("a", headerSize))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Eventually(t, func() bool {
+		return request(512) == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// net/http tolerates a few kilobytes beyond the limit before rejecting the request.
+	require.Equal(t, http.StatusRequestHeaderFieldsTooLarge, request(16*1024))
+}
+
+func TestServerDraining(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	var documentService mockDocumentService
+	documentService.
+		On("Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0, mock.Anything).
+		Run(func(mock.Arguments) { <-release }).
+		Return(nil).
+		Once()
+	documentService.On("Stats").Return(service.WorkerStats{})
+
+	port := freePort(t)
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(err error) { t.Errorf("unexpected server error: %s", err) },
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		Port:              port,
+	}
+	require.NoError(t, s.Init())
+	s.Start()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	inFlight := make(chan int)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/documents/bucket/file.pdf?page=1", port))
+		require.NoError(t, err)
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&s.inFlight) == 1 }, time.Second, time.Millisecond)
+
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&s.draining) == 1 }, time.Second, time.Millisecond)
+
+	// The new requests are rejected while the in-flight one is still running.
+	for path, expected := range map[string]int{
+		"/documents/bucket/file.pdf?page=1": http.StatusServiceUnavailable,
+		"/readyz":                           http.StatusServiceUnavailable,
+		"/health":                           http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, expected, w.Code, path)
+	}
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-inFlight)
+	require.NoError(t, <-stopped)
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.
+		On("Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0, mock.Anything).
+		Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+		Return(context.DeadlineExceeded)
+
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(error) {},
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		RequestTimeout:    50 * time.Millisecond,
+	}
+	require.NoError(t, s.Init())
+	s.initRouter()
+
+	// The render is canceled once the timeout is reached.
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/documents/bucket/file.pdf?page=1", nil))
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestServerConditionalRequest(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	payload, err := os.ReadFile("../service/testdata/sample.pdf")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sample.pdf"), payload, 0o600))
+
+	worker := service.Worker{
+		HTTPClient:          http.DefaultClient,
+		URLSigningSecret:    "secret",
+		TraceExtractor:      nopTraceExtractor,
+		StorageBucketRegion: map[string]string{"bucket": "us-east-1"},
+		LocalDir:            dir,
+	}
+	require.NoError(t, worker.Init())
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(error) {},
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &worker,
+	}
+	require.NoError(t, s.Init())
+	s.initRouter()
+
+	signedURL := worker.SignURL("/documents/file://sample.pdf", url.Values{"page": {"1"}})
+	request := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The token is checked before the conditional header.
+	w := request("/documents/file://sample.pdf?page=1", "*")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Empty(t, w.Header().Get("ETag"))
+
+	w = request(signedURL, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// The conditional header reaches the handler, the page isn't rendered again.
+	for _, ifNoneMatch := range []string{etag, "*"} {
+		w = request(signedURL, ifNoneMatch)
+		require.Equal(t, http.StatusNotModified, w.Code, ifNoneMatch)
+		require.Equal(t, etag, w.Header().Get("ETag"))
+		require.Empty(t, w.Body.String())
+	}
+
+	// The changed document is rendered again with another tag.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sample.pdf"), append(payload, '\n'), 0o600))
+	w = request(signedURL, etag)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+	require.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// The other responses still can't be cached.
+	w = request("/health", "")
+	require.Contains(t, w.Header().Get("Cache-Control"), "no-store")
+}
+
+func TestServerInitTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message       string
+		certFile      string
+		keyFile       string
+		minVersion    uint16
+		expectedError string
+	}{
+		{
+			message:       "fail when only the certificate is set",
+			certFile:      "cert.pem",
+			expectedError: "internal/transport.Server.TLSCertFile and TLSKeyFile must be set together",
+		},
+		{
+			message:       "fail when only the key is set",
+			keyFile:       "key.pem",
+			expectedError: "internal/transport.Server.TLSCertFile and TLSKeyFile must be set together",
+		},
+		{
+			message:       "fail with a minimum version lower than TLS 1.2",
+			certFile:      "cert.pem",
+			keyFile:       "key.pem",
+			minVersion:    tls.VersionTLS10,
+			expectedError: "internal/transport.Server.TLSMinVersion can't be lower than TLS 1.2",
+		},
+		{
+			message: "initialize without TLS",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			s := Server{
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &mockDocumentService{},
+				TLSCertFile:       tt.certFile,
+				TLSKeyFile:        tt.keyFile,
+				TLSMinVersion:     tt.minVersion,
+			}
+			err := s.Init()
+			require.Equal(t, tt.expectedError == "", err == nil)
+			if tt.expectedError != "" {
+				require.Equal(t, tt.expectedError, err.Error())
+			}
+		})
+	}
+}
+
+func TestServerBasePath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		basePath       string
+		target         string
+		expectedURL    string
+		expectedStatus int
+	}{
+		{
+			message:        "route a request without a base path",
+			target:         "/documents/bucket/file.pdf?token=abc",
+			expectedURL:    "/documents/bucket/file.pdf?token=abc",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			message:        "route a request under the base path",
+			basePath:       "/raster",
+			target:         "/raster/documents/bucket/file.pdf?token=abc",
+			expectedURL:    "/documents/bucket/file.pdf?token=abc",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			message:        "not route a request outside the base path",
+			basePath:       "/raster",
+			target:         "/documents/bucket/file.pdf?token=abc",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			message:        "route the health check under the base path",
+			basePath:       "/raster",
+			target:         "/raster/health",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			defer documentService.AssertExpectations(t)
+			if tt.expectedURL != "" {
+				documentService.
+					On("Metadata", mock.Anything, tt.expectedURL, "bucket/file.pdf").
+					Return("file.pdf", 1, nil)
+			}
+			documentService.On("Stats").Return(service.WorkerStats{}).Maybe()
+
+			s := Server{
+				Logger:            zerolog.Nop(),
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &documentService,
+				BasePath:          tt.basePath,
+			}
+			require.NoError(t, s.Init())
+			s.initRouter()
+
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	t.Parallel()
+
+	var documentService mockDocumentService
+	documentService.
+		On("Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0, mock.Anything).
+		Return(nil)
+
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(error) {},
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+		MetricsRegistry:   prometheus.NewRegistry(),
+	}
+	require.NoError(t, s.Init())
+	s.initRouter()
+
+	for _, target := range []string{"/documents/bucket/file.pdf?page=1", "/documents/bucket/file.pdf?page=abc"} {
+		s.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `lazyraster_http_requests_total{route="/documents/*",status="200"} 1`)
+	require.Contains(t, w.Body.String(), `lazyraster_http_requests_total{route="/documents/*",status="400"} 1`)
+}
+
+func TestServerSign(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		secret         string
+		target         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			message:        "sign the path with the other parameters",
+			secret:         "admin",
+			target:         "/sign?path=/documents/bucket/file.pdf&page=1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"url":"/documents/bucket/file.pdf?page=1&token=abc"}`,
+		},
+		{
+			message:        "reject a request without the path",
+			secret:         "admin",
+			target:         "/sign?page=1",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			message:        "reject a request with the wrong secret",
+			secret:         "wrong",
+			target:         "/sign?path=/documents/bucket/file.pdf&page=1",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			documentService.
+				On("SignURL", "/documents/bucket/file.pdf", url.Values{"page": []string{"1"}}).
+				Return("/documents/bucket/file.pdf?page=1&token=abc").
+				Maybe()
+
+			s := Server{
+				Logger:            zerolog.Nop(),
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &documentService,
+				AdminSecret:       "admin",
+			}
+			require.NoError(t, s.Init())
+			s.initRouter()
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("X-Admin-Secret", tt.secret)
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				require.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		method         string
+		target         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			message:        "list the cached documents",
+			method:         http.MethodGet,
+			target:         "/cache",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"documents":[{"path":"bucket/file.pdf","size":42}]}`,
+		},
+		{
+			message:        "purge a document",
+			method:         http.MethodDelete,
+			target:         "/cache?path=bucket/file.pdf",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"purged":1}`,
+		},
+		{
+			message:        "purge every document",
+			method:         http.MethodDelete,
+			target:         "/cache",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"purged":3}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			documentService.
+				On("CachedDocuments").
+				Return([]service.CachedDocument{{Path: "bucket/file.pdf", Size: 42}}).
+				Maybe()
+			documentService.On("PurgeCache", "bucket/file.pdf").Return(1).Maybe()
+			documentService.On("PurgeCache", "").Return(3).Maybe()
+
+			s := Server{
+				Logger:            zerolog.Nop(),
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &documentService,
+				AdminSecret:       "admin",
+			}
+			require.NoError(t, s.Init())
+			s.initRouter()
+
+			// The routes require the admin secret.
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.Header.Set("X-Admin-Secret", "admin")
+			w = httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			require.Equal(t, tt.expectedStatus, w.Code)
+			require.JSONEq(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestServerPreflight(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message        string
+		target         string
+		allowedOrigins []string
+		origin         string
+		expectedOrigin string
+	}{
+		{
+			message:        "allow a preflight from a configured origin",
+			target:         "/documents/bucket/file.pdf?page=1",
+			allowedOrigins: []string{"https://app.example.com"},
+			origin:         "https://app.example.com",
+			expectedOrigin: "https://app.example.com",
+		},
+		{
+			message:        "allow a preflight from any origin",
+			target:         "/documents/bucket/file.pdf?page=1",
+			allowedOrigins: []string{"*"},
+			origin:         "https://app.example.com",
+			expectedOrigin: "https://app.example.com",
+		},
+		{
+			message:        "not allow a preflight from an unknown origin",
+			target:         "/documents/bucket/file.pdf?page=1",
+			allowedOrigins: []string{"https://app.example.com"},
+			origin:         "https://evil.example.com",
+		},
+		{
+			message:        "allow a preflight to the other document routes",
+			target:         "/thumbnail/bucket/file.pdf",
+			allowedOrigins: []string{"https://app.example.com"},
+			origin:         "https://app.example.com",
+			expectedOrigin: "https://app.example.com",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			s := Server{
+				Logger:             zerolog.Nop(),
+				AsyncErrorHandler:  func(error) {},
+				TraceExtractor:     nopTraceExtractor,
+				DocumentService:    &mockDocumentService{},
+				CORSAllowedOrigins: tt.allowedOrigins,
+			}
+			require.NoError(t, s.Init())
+			s.initRouter()
+
+			req := httptest.NewRequest(http.MethodOptions, tt.target, nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "datadog-resource-prefix")
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusNoContent, w.Code)
+			require.Equal(t, tt.expectedOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+			if tt.expectedOrigin != "" {
+				require.Equal(t, "GET, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+				require.Equal(t, "datadog-resource-prefix", w.Header().Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
+
+func TestServerDropboxTrailingSlash(t *testing.T) {
+	t.Parallel()
+
+	// The base64 encoding of 'https://www.dropbox.com/s/abc/file.pdf?dl=0&v=??' ends with a slash.
+	path := "dropbox/aHR0cHM6Ly93d3cuZHJvcGJveC5jb20vcy9hYmMvZmlsZS5wZGY/ZGw9MCZ2PT8/"
+	target := "/documents/" + path + "?page=1"
+
+	var documentService mockDocumentService
+	defer documentService.AssertExpectations(t)
+	documentService.
+		On("Process", mock.Anything, target, path, 1, 0, float32(0), "png", 0, mock.Anything).
+		Return(nil)
+
+	s := Server{
+		Logger:            zerolog.Nop(),
+		AsyncErrorHandler: func(error) {},
+		TraceExtractor:    nopTraceExtractor,
+		DocumentService:   &documentService,
+	}
+	require.NoError(t, s.Init())
+	s.initRouter()
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServerCompression(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message          string
+		compressionLevel int
+		target           string
+		expectedEncoding string
+		expectedXFL      byte
+	}{
+		{
+			message:          "compress the JSON responses with the best compression",
+			compressionLevel: 9,
+			target:           "/documents/bucket/file.pdf",
+			expectedEncoding: "gzip",
+			expectedXFL:      2,
+		},
+		{
+			message:          "compress the JSON responses with the best speed",
+			compressionLevel: 1,
+			target:           "/documents/bucket/file.pdf",
+			expectedEncoding: "gzip",
+			expectedXFL:      4,
+		},
+		{
+			message:          "not compress the rendered pages",
+			compressionLevel: 9,
+			target:           "/documents/bucket/file.pdf?page=1",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Should "+tt.message, func(t *testing.T) {
+			t.Parallel()
+
+			var documentService mockDocumentService
+			documentService.
+				On("Metadata", mock.Anything, mock.Anything, "bucket/file.pdf").
+				Return("file.pdf", 1, nil).
+				Maybe()
+			documentService.
+				On(
+					"Process", mock.Anything, mock.Anything, "bucket/file.pdf", 1, 0, float32(0), "png", 0,
+					mock.Anything,
+				).
+				Run(func(args mock.Arguments) { _, _ = args.Get(8).(io.Writer).Write([]byte("rendered page")) }).
+				Return(nil).
+				Maybe()
+
+			s := Server{
+				Logger:            zerolog.Nop(),
+				AsyncErrorHandler: func(error) {},
+				TraceExtractor:    nopTraceExtractor,
+				DocumentService:   &documentService,
+				CompressionLevel:  tt.compressionLevel,
+			}
+			require.NoError(t, s.Init())
+			s.initRouter()
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expectedEncoding, w.Header().Get("Content-Encoding"))
+			if tt.expectedEncoding == "" {
+				require.Equal(t, "rendered page", w.Body.String())
+				return
+			}
+
+			// The gzip header flags the compression level used.
+			require.Greater(t, w.Body.Len(), 8)
+			require.Equal(t, tt.expectedXFL, w.Body.Bytes()[8])
+		})
+	}
+}
+
+func TestServerSetRenderLimits(t *testing.T) {
+	t.Parallel()
+
+	s := Server{
+		AsyncErrorHandler:    func(error) {},
+		TraceExtractor:       nopTraceExtractor,
+		DocumentService:      &mockDocumentService{},
+		MaxConcurrentRenders: 1,
+		RenderQueueDepth:     1,
+	}
+	require.NoError(t, s.Init())
+
+	require.NoError(t, s.renderQueue.acquire(context.Background(), renderPriorityNormal))
+	acquired := make(chan error)
+	go func() { acquired <- s.renderQueue.acquire(context.Background(), renderPriorityNormal) }()
+	require.Eventually(t, func() bool {
+		_, waiting := s.renderQueue.stats()
+		return waiting == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, s.SetRenderLimits(2, 1))
+	require.NoError(t, <-acquired)
+	active, waiting := s.renderQueue.stats()
+	require.Equal(t, 2, active)
+	require.Zero(t, waiting)
+
+	// Shrinking the concurrency drops the released slots until the active renders fit the new limit.
+	require.NoError(t, s.SetRenderLimits(1, 0))
+	s.renderQueue.release()
+	require.Equal(t, errRenderQueueFull, s.renderQueue.acquire(context.Background(), renderPriorityNormal))
+
+	require.EqualError(t, s.SetRenderLimits(0, 1), "the max concurrent renders must be bigger than zero")
+	require.EqualError(
+		t, (&Server{}).SetRenderLimits(1, 1), "the render queue is disabled, enabling it requires a restart",
+	)
+}
+
+func TestServerSetRateLimit(t *testing.T) {
+	t.Parallel()
+
+	s := Server{
+		AsyncErrorHandler:  func(error) {},
+		TraceExtractor:     nopTraceExtractor,
+		DocumentService:    &mockDocumentService{},
+		RateLimit:          0.001,
+		MaxDocumentRenders: 1,
+	}
+	require.NoError(t, s.Init())
+
+	require.True(t, s.clientRateLimiter.allow("client"))
+	require.False(t, s.clientRateLimiter.allow("client"))
+
+	// The clients already seen get the new rate too.
+	require.NoError(t, s.SetRateLimit(1000, 2))
+	require.Eventually(t, func() bool {
+		return s.clientRateLimiter.allow("client")
+	}, time.Second, time.Millisecond)
+	require.True(t, s.clientRateLimiter.allow("other"))
+	require.True(t, s.clientRateLimiter.allow("other"))
+
+	require.True(t, s.documentLimiter.acquire("document"))
+	require.False(t, s.documentLimiter.acquire("document"))
+	require.NoError(t, s.SetMaxDocumentRenders(2))
+	require.True(t, s.documentLimiter.acquire("document"))
+
+	require.EqualError(t, s.SetRateLimit(0, 1), "the rate limit must be bigger than zero")
+	require.EqualError(t, s.SetMaxDocumentRenders(0), "the max document renders must be bigger than zero")
+	require.EqualError(
+		t, (&Server{}).SetRateLimit(1, 1), "the rate limit is disabled, enabling it requires a restart",
+	)
+}
+
+// freePort returns a port that is available to listen on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+type mockDocumentService struct {
+	mock.Mock
+}
+
+func (m *mockDocumentService) Process(
+	ctx context.Context, url, path string, page int, width int, scale float32, format string, quality int,
+	output io.Writer,
+) error {
+	args := m.Called(ctx, url, path, page, width, scale, format, quality, output)
+	return args.Error(0)
+}
+
+func (m *mockDocumentService) Cover(
+	ctx context.Context, url, path string, page int, format string, output io.Writer,
+) error {
+	args := m.Called(ctx, url, path, page, format, output)
+	return args.Error(0)
+}
+
+func (m *mockDocumentService) Metadata(ctx context.Context, url, path string) (string, int, error) {
+	args := m.Called(ctx, url, path)
+	return args.String(0), args.Int(1), args.Error(2)
+}
+
+func (m *mockDocumentService) Placeholder(ctx context.Context, url, path string, page int) (string, error) {
+	args := m.Called(ctx, url, path, page)
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockDocumentService) Diff(
+	ctx context.Context, url, path, fromVersion, toVersion string, width int, changed func(service.PageDiff) error,
+) error {
+	args := m.Called(ctx, url, path, fromVersion, toVersion, width, changed)
+	return args.Error(0)
+}
+
+func (m *mockDocumentService) Validate(ctx context.Context, url, path string) ([]service.PageValidation, error) {
+	args := m.Called(ctx, url, path)
+	return args.Get(0).([]service.PageValidation), args.Error(1)
+}
+
+func (m *mockDocumentService) ContactSheet(
+	ctx context.Context, url, path string, columns, thumbWidth, maxPages int, output io.Writer,
+) error {
+	args := m.Called(ctx, url, path, columns, thumbWidth, maxPages, output)
+	return args.Error(0)
+}
+
+func (m *mockDocumentService) SignURL(path string, query url.Values) string {
+	args := m.Called(path, query)
+	return args.String(0)
+}
+
+func (m *mockDocumentService) CachedDocuments() []service.CachedDocument {
+	args := m.Called()
+	return args.Get(0).([]service.CachedDocument)
+}
+
+func (m *mockDocumentService) PurgeCache(path string) int {
+	args := m.Called(path)
+	return args.Int(0)
+}
+
+func (m *mockDocumentService) Stats() service.WorkerStats {
+	args := m.Called()
+	return args.Get(0).(service.WorkerStats)
+}
+
+func nopTraceExtractor(context.Context, zerolog.Logger) (zerolog.Logger, error) {
+	return zerolog.Nop(), nil
+}
@@ -1,17 +1,54 @@
 package transport
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
 const (
-	maxBodySize = 100000 // 100kb.
+	maxBodySize             = 100000 // 100kb.
+	defaultMaxHeaderBytes   = 100000 // 100kb.
+	defaultCompressionLevel = 5
+	defaultPort             = 8080
+	defaultReadTimeout      = 10 * time.Second
+	defaultWriteTimeout     = 10 * time.Second
+	defaultIdleTimeout      = 30 * time.Second
+	defaultRequestTimeout   = 5 * time.Second
+	defaultThumbnailWidth   = 150
+	maxThumbnailWidth       = 600
+
+	// maxArchivePages bounds the pages rendered by a single request with the 'pages' parameter.
+	maxArchivePages = 20
+
+	// pageCacheControl lets the clients keep the rendered pages, as long as they're revalidated with the ETag.
+	pageCacheControl = "private, no-cache"
+
+	// maxPooledBufferSize keeps the buffers of unusually big pages from being held by the pool.
+	maxPooledBufferSize = 16 << 20
 )
 
+// bufferPool holds the buffers of the rendered pages, they're reused across the requests to reduce the GC pressure.
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// acquireBuffer returns an empty buffer from the pool, it must be given back with releaseBuffer once it's done.
+func acquireBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
 type traceExtractor func(context.Context, zerolog.Logger) (zerolog.Logger, error)
 
 type writer struct {
@@ -51,13 +88,23 @@ func (wrt writer) response(ctx context.Context, w http.ResponseWriter, r interfa
 
 // Error is used to generate a proper error content to be sent to the client.
 func (wrt writer) error(ctx context.Context, w http.ResponseWriter, title string, err error, status int) {
+	wrt.errorWithReason(ctx, w, title, "", err, status)
+}
+
+// errorWithReason is like error but includes a machine-readable reason that clients can use to tell errors apart
+// without parsing the title.
+func (wrt writer) errorWithReason(
+	ctx context.Context, w http.ResponseWriter, title, reason string, err error, status int,
+) {
 	resp := struct {
 		Error struct {
 			Title  string `json:"title"`
+			Reason string `json:"reason,omitempty"`
 			Detail string `json:"detail,omitempty"`
 		} `json:"error"`
 	}{}
 	resp.Error.Title = title
+	resp.Error.Reason = reason
 	if err != nil {
 		resp.Error.Detail = err.Error()
 	}